@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+// Attributes from RFC 5780 NAT Behavior Discovery.
+const (
+	attrChangeRequest  stun.AttrType = 0x0003 // CHANGE-REQUEST
+	attrPadding        stun.AttrType = 0x0026 // PADDING
+	attrResponsePort   stun.AttrType = 0x0027 // RESPONSE-PORT
+	attrResponseOrigin stun.AttrType = 0x802b // RESPONSE-ORIGIN
+	attrOtherAddress   stun.AttrType = 0x802c // OTHER-ADDRESS
+)
+
+const (
+	familyIPv4 uint16 = 0x01
+	familyIPv6 uint16 = 0x02
+)
+
+// addrAttr is address attribute that is encoded like MAPPED-ADDRESS,
+// but with different type, e.g. OTHER-ADDRESS or RESPONSE-ORIGIN.
+type addrAttr struct {
+	Type stun.AttrType
+	IP   net.IP
+	Port int
+}
+
+// AddTo adds attribute to message.
+func (a addrAttr) AddTo(m *stun.Message) error {
+	var (
+		family = familyIPv4
+		ip     = a.IP.To4()
+	)
+	if ip == nil {
+		family = familyIPv6
+		ip = a.IP.To16()
+	}
+	if ip == nil {
+		return stun.ErrBadIPLength
+	}
+	v := make([]byte, 4+len(ip))
+	binary.BigEndian.PutUint16(v[0:2], family)
+	binary.BigEndian.PutUint16(v[2:4], uint16(a.Port))
+	copy(v[4:], ip)
+	m.Add(a.Type, v)
+	return nil
+}
+
+// Flags of CHANGE-REQUEST attribute.
+const (
+	changeIP   uint32 = 0x04
+	changePort uint32 = 0x02
+)
+
+// changeRequest represents CHANGE-REQUEST attribute.
+//
+// RFC 5780 Section 7.2
+type changeRequest struct {
+	IP   bool
+	Port bool
+}
+
+var errBadChangeRequest = errors.New("bad CHANGE-REQUEST size")
+
+// AddTo adds CHANGE-REQUEST to message.
+func (c changeRequest) AddTo(m *stun.Message) error {
+	var flags uint32
+	if c.IP {
+		flags |= changeIP
+	}
+	if c.Port {
+		flags |= changePort
+	}
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, flags)
+	m.Add(attrChangeRequest, v)
+	return nil
+}
+
+// GetFrom decodes CHANGE-REQUEST from message.
+func (c *changeRequest) GetFrom(m *stun.Message) error {
+	v, err := m.Get(attrChangeRequest)
+	if err != nil {
+		return err
+	}
+	if len(v) != 4 {
+		return errBadChangeRequest
+	}
+	flags := binary.BigEndian.Uint32(v)
+	c.IP = flags&changeIP != 0
+	c.Port = flags&changePort != 0
+	return nil
+}
+
+// responsePort represents RESPONSE-PORT attribute.
+//
+// RFC 5780 Section 7.5
+type responsePort int
+
+var errBadResponsePort = errors.New("bad RESPONSE-PORT size")
+
+// AddTo adds RESPONSE-PORT to message.
+func (p responsePort) AddTo(m *stun.Message) error {
+	// Port is followed by 2 bytes of padding.
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint16(v[0:2], uint16(p))
+	m.Add(attrResponsePort, v)
+	return nil
+}
+
+// GetFrom decodes RESPONSE-PORT from message.
+func (p *responsePort) GetFrom(m *stun.Message) error {
+	v, err := m.Get(attrResponsePort)
+	if err != nil {
+		return err
+	}
+	if len(v) < 2 {
+		return errBadResponsePort
+	}
+	*p = responsePort(binary.BigEndian.Uint16(v[0:2]))
+	return nil
+}
+
+// Transport protocol number for REQUESTED-TRANSPORT, only UDP is
+// allowed by RFC 5766.
+const protoUDP = 17
+
+// requestedTransport represents REQUESTED-TRANSPORT attribute.
+//
+// RFC 5766 Section 14.7
+type requestedTransport byte
+
+var errBadRequestedTransport = errors.New("bad REQUESTED-TRANSPORT size")
+
+// AddTo adds REQUESTED-TRANSPORT to message.
+func (t requestedTransport) AddTo(m *stun.Message) error {
+	m.Add(stun.AttrRequestedTransport, []byte{byte(t), 0, 0, 0})
+	return nil
+}
+
+// GetFrom decodes REQUESTED-TRANSPORT from message.
+func (t *requestedTransport) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrRequestedTransport)
+	if err != nil {
+		return err
+	}
+	if len(v) != 4 {
+		return errBadRequestedTransport
+	}
+	*t = requestedTransport(v[0])
+	return nil
+}
+
+// lifetime represents LIFETIME attribute.
+//
+// RFC 5766 Section 14.2
+type lifetime time.Duration
+
+var errBadLifetime = errors.New("bad LIFETIME size")
+
+// AddTo adds LIFETIME to message.
+func (l lifetime) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(time.Duration(l)/time.Second))
+	m.Add(stun.AttrLifetime, v)
+	return nil
+}
+
+// GetFrom decodes LIFETIME from message.
+func (l *lifetime) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrLifetime)
+	if err != nil {
+		return err
+	}
+	if len(v) != 4 {
+		return errBadLifetime
+	}
+	*l = lifetime(time.Duration(binary.BigEndian.Uint32(v)) * time.Second)
+	return nil
+}
+
+// channelNumber represents CHANNEL-NUMBER attribute.
+//
+// RFC 5766 Section 14.1
+type channelNumber uint16
+
+var errBadChannelNumber = errors.New("bad CHANNEL-NUMBER size")
+
+// GetFrom decodes CHANNEL-NUMBER from message.
+func (n *channelNumber) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrChannelNumber)
+	if err != nil {
+		return err
+	}
+	if len(v) != 4 {
+		return errBadChannelNumber
+	}
+	*n = channelNumber(binary.BigEndian.Uint16(v[0:2]))
+	return nil
+}
+
+// xorAddr is address attribute that is encoded like
+// XOR-MAPPED-ADDRESS, but with different type, e.g. XOR-PEER-ADDRESS.
+type xorAddr struct {
+	Type stun.AttrType
+	IP   net.IP
+	Port int
+}
+
+// AddTo adds attribute to message.
+func (a xorAddr) AddTo(m *stun.Message) error {
+	return stun.XORMappedAddress{IP: a.IP, Port: a.Port}.AddToAs(m, a.Type)
+}
+
+// rawData represents DATA attribute.
+//
+// RFC 5766 Section 14.4
+type rawData []byte
+
+// AddTo adds DATA to message.
+func (d rawData) AddTo(m *stun.Message) error {
+	m.Add(stun.AttrData, d)
+	return nil
+}
+
+// xorAddresses decodes all attributes of type t that are encoded as
+// XOR-MAPPED-ADDRESS, e.g. multiple XOR-PEER-ADDRESS attributes of
+// CreatePermission request.
+func xorAddresses(m *stun.Message, t stun.AttrType) ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	for _, a := range m.Attributes {
+		if a.Type != t {
+			continue
+		}
+		// Decoding every attribute via temporary message, because
+		// XORMappedAddress.GetFromAs decodes only first one.
+		tmp := &stun.Message{
+			TransactionID: m.TransactionID,
+			Attributes:    stun.Attributes{a},
+		}
+		var addr stun.XORMappedAddress
+		if err := addr.GetFromAs(tmp, t); err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+	}
+	return addrs, nil
+}
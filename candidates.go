@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/gortc/ice"
+)
+
+// typePreferences are recommended type preferences of candidates,
+// RFC 8445 Section 5.1.2.2.
+var typePreferences = map[ice.CandidateType]int{
+	ice.CandidateHost:            126,
+	ice.CandidatePeerReflexive:   110,
+	ice.CandidateServerReflexive: 100,
+	ice.CandidateRelay:           0,
+}
+
+// candidatePriority returns priority of candidate, RFC 8445 Section 5.1.2.1.
+func candidatePriority(typePreference, localPreference, componentID int) int {
+	return 1<<24*typePreference + 1<<8*localPreference + 256 - componentID
+}
+
+// priorityReport is breakdown of candidate priority.
+type priorityReport struct {
+	TypePreference  int `json:"type_preference"`
+	LocalPreference int `json:"local_preference"`
+	// Expected is priority recomputed from recommended type preference,
+	// local preference and component ID.
+	Expected int `json:"expected"`
+	// Mismatches describe differences from expected priority.
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+func newPriorityReport(c ice.Candidate) priorityReport {
+	r := priorityReport{
+		TypePreference:  c.Priority >> 24,
+		LocalPreference: c.Priority >> 8 & 0xFFFF,
+	}
+	recommended := typePreferences[c.Type]
+	r.Expected = candidatePriority(recommended, r.LocalPreference, c.ComponentID)
+	if r.TypePreference != recommended {
+		r.Mismatches = append(r.Mismatches, fmt.Sprintf(
+			"type preference %d differs from recommended %d for %s",
+			r.TypePreference, recommended, c.Type,
+		))
+	}
+	if component := 256 - c.Priority&0xFF; component != c.ComponentID {
+		r.Mismatches = append(r.Mismatches, fmt.Sprintf(
+			"encoded component ID %d differs from %d", component, c.ComponentID,
+		))
+	}
+	return r
+}
+
+// indexedCandidate is candidate parsed from SDP line with index.
+type indexedCandidate struct {
+	Index     int
+	Candidate ice.Candidate
+}
+
+func candidateAddr(c ice.Candidate) string {
+	return net.JoinHostPort(c.ConnectionAddress.String(), strconv.Itoa(c.Port))
+}
+
+// candidateBase returns base address of candidate, which is related
+// address for server reflexive candidates, RFC 8445 Section 5.1.1.
+func candidateBase(c ice.Candidate) string {
+	if c.Type == ice.CandidateServerReflexive && c.RelatedPort != 0 {
+		return net.JoinHostPort(c.RelatedAddress.String(), strconv.Itoa(c.RelatedPort))
+	}
+	return candidateAddr(c)
+}
+
+// foundationReport is group of candidates with same foundation.
+type foundationReport struct {
+	Foundation int    `json:"foundation"`
+	Type       string `json:"type"`
+	Transport  string `json:"transport"`
+	// Lines are indexes of candidate lines.
+	Lines []int `json:"lines"`
+	// Mismatches describe candidates that should not share foundation,
+	// RFC 8445 Section 5.1.1.3.
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+func newFoundationReports(candidates []indexedCandidate) []foundationReport {
+	var (
+		reports []foundationReport
+		byID    = make(map[int]int)
+	)
+	for _, ic := range candidates {
+		c := ic.Candidate
+		i, ok := byID[c.Foundation]
+		if !ok {
+			i = len(reports)
+			byID[c.Foundation] = i
+			reports = append(reports, foundationReport{
+				Foundation: c.Foundation,
+				Type:       c.Type.String(),
+				Transport:  c.Transport.String(),
+			})
+		}
+		r := &reports[i]
+		r.Lines = append(r.Lines, ic.Index)
+		if t := c.Type.String(); t != r.Type {
+			r.Mismatches = append(r.Mismatches, fmt.Sprintf(
+				"line %d has type %s instead of %s", ic.Index, t, r.Type,
+			))
+		}
+		if t := c.Transport.String(); t != r.Transport {
+			r.Mismatches = append(r.Mismatches, fmt.Sprintf(
+				"line %d has transport %s instead of %s", ic.Index, t, r.Transport,
+			))
+		}
+	}
+	return reports
+}
+
+// sampleRemoteCandidates returns typical candidates of remote agent
+// behind NAT for component, used to simulate pairing.
+func sampleRemoteCandidates(componentID int) []ice.Candidate {
+	var candidates []ice.Candidate
+	for i, s := range []struct {
+		t       ice.CandidateType
+		ip      string
+		related string
+	}{
+		{t: ice.CandidateHost, ip: "192.168.1.2"},
+		{t: ice.CandidateHost, ip: "2001:db8::2"},
+		{t: ice.CandidateServerReflexive, ip: "203.0.113.2", related: "192.168.1.2"},
+		{t: ice.CandidateRelay, ip: "198.51.100.2", related: "203.0.113.2"},
+	} {
+		c := ice.Candidate{
+			Foundation:  i + 1,
+			ComponentID: componentID,
+			Priority:    candidatePriority(typePreferences[s.t], 65535-i, componentID),
+			Port:        50000 + i,
+			Transport:   ice.TransportUDP,
+			Type:        s.t,
+		}
+		c.ConnectionAddress.IP = net.ParseIP(s.ip)
+		if c.ConnectionAddress.IP.To4() == nil {
+			c.ConnectionAddress.Type = ice.AddressIPv6
+		}
+		if s.related != "" {
+			c.RelatedAddress.IP = net.ParseIP(s.related)
+			c.RelatedPort = 50000
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// pairPriority returns priority of pair, where g is priority of
+// controlling agent candidate and d of controlled, RFC 8445 Section 6.1.2.3.
+func pairPriority(g, d int) uint64 {
+	var (
+		min, max = uint64(g), uint64(d)
+		bit      uint64
+	)
+	if min > max {
+		min, max = max, min
+	}
+	if g > d {
+		bit = 1
+	}
+	return 1<<32*min + 2*max + bit
+}
+
+// pairReport is simulated candidate pair.
+type pairReport struct {
+	Local    string `json:"local"`
+	Remote   string `json:"remote"`
+	Type     string `json:"type"` // local/remote candidate types
+	Priority uint64 `json:"priority"`
+	// State is initial state, "waiting" or "frozen", RFC 8445 Section 6.1.2.6.
+	State string `json:"state"`
+
+	foundation string
+}
+
+// componentReport is checklist of single component.
+type componentReport struct {
+	ComponentID int          `json:"component"`
+	Remote      []string     `json:"remote"`
+	Pairs       []pairReport `json:"pairs"`
+	// Pruned is count of redundant pairs, RFC 8445 Section 6.1.2.4.
+	Pruned int `json:"pruned,omitempty"`
+}
+
+// canPair reports whether local and remote candidates can form pair,
+// RFC 8445 Section 6.1.2.2.
+func canPair(local, remote ice.Candidate) bool {
+	if local.ComponentID != remote.ComponentID || local.Transport != remote.Transport {
+		return false
+	}
+	// FQDN addresses are resolved before pairing.
+	t := local.ConnectionAddress.Type
+	return t != ice.AddressFQDN && t == remote.ConnectionAddress.Type
+}
+
+// newComponentReports simulates checklist for candidates as controlling
+// agent against sample remote candidates.
+func newComponentReports(candidates []indexedCandidate) []componentReport {
+	var (
+		reports     []componentReport
+		byComponent = make(map[int][]ice.Candidate)
+	)
+	for _, ic := range candidates {
+		c := ic.Candidate
+		if _, ok := byComponent[c.ComponentID]; !ok {
+			reports = append(reports, componentReport{ComponentID: c.ComponentID})
+		}
+		byComponent[c.ComponentID] = append(byComponent[c.ComponentID], c)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].ComponentID < reports[j].ComponentID
+	})
+	for i := range reports {
+		r := &reports[i]
+		remote := sampleRemoteCandidates(r.ComponentID)
+		for _, c := range remote {
+			r.Remote = append(r.Remote, c.Type.String()+" "+candidateAddr(c))
+		}
+		seen := make(map[string]bool)
+		for _, l := range byComponent[r.ComponentID] {
+			for _, c := range remote {
+				if !canPair(l, c) {
+					continue
+				}
+				r.Pairs = append(r.Pairs, pairReport{
+					// Server reflexive candidates are replaced by base.
+					Local:      candidateBase(l),
+					Remote:     candidateAddr(c),
+					Type:       l.Type.String() + "/" + c.Type.String(),
+					Priority:   pairPriority(l.Priority, c.Priority),
+					foundation: strconv.Itoa(l.Foundation) + "/" + strconv.Itoa(c.Foundation),
+				})
+			}
+		}
+		sort.SliceStable(r.Pairs, func(i, j int) bool {
+			return r.Pairs[i].Priority > r.Pairs[j].Priority
+		})
+		pairs := r.Pairs[:0]
+		for _, p := range r.Pairs {
+			key := p.Local + " " + p.Remote
+			if seen[key] {
+				r.Pruned++
+				continue
+			}
+			seen[key] = true
+			pairs = append(pairs, p)
+		}
+		r.Pairs = pairs
+	}
+	// Pair with lowest component ID for each foundation is unfrozen.
+	unfrozen := make(map[string]bool)
+	for i := range reports {
+		for k := range reports[i].Pairs {
+			p := &reports[i].Pairs[k]
+			p.State = "frozen"
+			if !unfrozen[p.foundation] {
+				unfrozen[p.foundation] = true
+				p.State = "waiting"
+			}
+		}
+	}
+	return reports
+}
+
+// candidatesReport is verification of all candidates in SDP.
+type candidatesReport struct {
+	Foundations []foundationReport `json:"foundations"`
+	Components  []componentReport  `json:"components"`
+}
+
+func newCandidatesReport(candidates []indexedCandidate) *candidatesReport {
+	return &candidatesReport{
+		Foundations: newFoundationReports(candidates),
+		Components:  newComponentReports(candidates),
+	}
+}
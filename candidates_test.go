@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/gortc/ice"
+)
+
+func TestCandidatePriority(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		typePref, localPref int
+		componentID         int
+		priority            int
+	}{
+		{name: "Host", typePref: 126, localPref: 65535, componentID: 1, priority: 2130706431},
+		{name: "HostRTCP", typePref: 126, localPref: 65535, componentID: 2, priority: 2130706430},
+		{name: "ServerReflexive", typePref: 100, localPref: 65535, componentID: 1, priority: 1694498815},
+		{name: "PeerReflexive", typePref: 110, localPref: 65535, componentID: 1, priority: 1862270975},
+		{name: "Relay", typePref: 0, localPref: 65535, componentID: 1, priority: 16777215},
+		{name: "LowLocalPreference", typePref: 126, localPref: 0, componentID: 1, priority: 2113929471},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if p := candidatePriority(tc.typePref, tc.localPref, tc.componentID); p != tc.priority {
+				t.Errorf("priority: %d, expected %d", p, tc.priority)
+			}
+		})
+	}
+}
+
+func TestPairPriority(t *testing.T) {
+	const (
+		host  = 2130706431
+		srflx = 1694498815
+		relay = 16777215
+	)
+	for _, tc := range []struct {
+		name     string
+		local    int
+		remote   int
+		role     string
+		priority uint64
+	}{
+		// Controlling agent is G, RFC 8445 Section 6.1.2.3.
+		{name: "Controlling", local: host, remote: srflx, role: "controlling", priority: 7277816997797167103},
+		{name: "Controlled", local: host, remote: srflx, role: "controlled", priority: 7277816997797167102},
+		{name: "ControllingLower", local: relay, remote: host, role: "controlling", priority: 72057594004373502},
+		{name: "ControlledLower", local: relay, remote: host, role: "controlled", priority: 72057594004373503},
+		{name: "Equal", local: host, remote: host, role: "controlling", priority: 9151314442783293438},
+		{name: "EqualControlled", local: host, remote: host, role: "controlled", priority: 9151314442783293438},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g, d := tc.local, tc.remote
+			if tc.role == "controlled" {
+				g, d = d, g
+			}
+			if p := pairPriority(g, d); p != tc.priority {
+				t.Errorf("priority: %d, expected %d", p, tc.priority)
+			}
+		})
+	}
+}
+
+func testCandidate(foundation, componentID int, t ice.CandidateType, addr string, port int) ice.Candidate {
+	c := ice.Candidate{
+		Foundation:  foundation,
+		ComponentID: componentID,
+		Priority:    candidatePriority(typePreferences[t], 65535, componentID),
+		Port:        port,
+		Transport:   ice.TransportUDP,
+		Type:        t,
+	}
+	if ip := net.ParseIP(addr); ip != nil {
+		c.ConnectionAddress.IP = ip
+	} else {
+		c.ConnectionAddress.Host = []byte(addr)
+		c.ConnectionAddress.Type = ice.AddressFQDN
+	}
+	return c
+}
+
+func TestNewComponentReports(t *testing.T) {
+	srflx := testCandidate(2, 1, ice.CandidateServerReflexive, "203.0.113.10", 2000)
+	srflx.RelatedAddress.IP = net.ParseIP("192.0.2.10")
+	srflx.RelatedPort = 1000
+	candidates := []indexedCandidate{
+		{Index: 1, Candidate: testCandidate(1, 2, ice.CandidateHost, "192.0.2.10", 1001)},
+		{Index: 2, Candidate: testCandidate(1, 1, ice.CandidateHost, "192.0.2.10", 1000)},
+		// Paired with base, so all pairs are redundant with host ones.
+		{Index: 3, Candidate: srflx},
+		// Only in component 2, so its pairs are not frozen.
+		{Index: 4, Candidate: testCandidate(4, 2, ice.CandidateRelay, "198.51.100.10", 3000)},
+		// FQDN is not paired before resolving.
+		{Index: 5, Candidate: testCandidate(3, 1, ice.CandidateHost, "a.local", 1002)},
+	}
+	reports := newComponentReports(candidates)
+	if len(reports) != 2 {
+		t.Fatalf("components: %d, expected 2", len(reports))
+	}
+	type pair struct {
+		Local, Remote, Type string
+		Priority            uint64
+		State               string
+	}
+	for i, tc := range []struct {
+		componentID int
+		pruned      int
+		pairs       []pair
+	}{
+		{
+			componentID: 1,
+			pruned:      3,
+			pairs: []pair{
+				{"192.0.2.10:1000", "192.168.1.2:50000", "host/host", 9151314442783293438, "waiting"},
+				{"192.0.2.10:1000", "203.0.113.2:50002", "host/server-reflexive", 7277814798773911551, "waiting"},
+				{"192.0.2.10:1000", "198.51.100.2:50003", "host/relay", 72054295469490175, "waiting"},
+			},
+		},
+		{
+			// Host foundations are unfrozen by pairs of component 1.
+			componentID: 2,
+			pairs: []pair{
+				{"192.0.2.10:1001", "192.168.1.2:50000", "host/host", 9151314438488326140, "frozen"},
+				{"192.0.2.10:1001", "203.0.113.2:50002", "host/server-reflexive", 7277814794478944253, "frozen"},
+				{"198.51.100.10:3000", "192.168.1.2:50000", "relay/host", 72057589709406204, "waiting"},
+				{"198.51.100.10:3000", "203.0.113.2:50002", "relay/server-reflexive", 72057588836989948, "waiting"},
+				{"192.0.2.10:1001", "198.51.100.2:50003", "host/relay", 72054291174522877, "frozen"},
+				{"198.51.100.10:3000", "198.51.100.2:50003", "relay/relay", 72054286946664445, "waiting"},
+			},
+		},
+	} {
+		r := reports[i]
+		if r.ComponentID != tc.componentID {
+			t.Errorf("component #%d: %d, expected %d", i, r.ComponentID, tc.componentID)
+		}
+		if r.Pruned != tc.pruned {
+			t.Errorf("component %d pruned: %d, expected %d", r.ComponentID, r.Pruned, tc.pruned)
+		}
+		var pairs []pair
+		for _, p := range r.Pairs {
+			pairs = append(pairs, pair{p.Local, p.Remote, p.Type, p.Priority, p.State})
+		}
+		if !reflect.DeepEqual(pairs, tc.pairs) {
+			t.Errorf("component %d pairs:\n%v\nexpected:\n%v", r.ComponentID, pairs, tc.pairs)
+		}
+	}
+}
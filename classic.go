@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"log"
+	"net"
+
+	"github.com/gortc/stun"
+)
+
+// Attributes from RFC 3489.
+const (
+	attrSourceAddress  stun.AttrType = 0x0004 // SOURCE-ADDRESS
+	attrChangedAddress stun.AttrType = 0x0005 // CHANGED-ADDRESS
+)
+
+const magicCookie = 0x2112A442
+
+var clientStats = expvar.NewMap("stun_clients")
+
+// isClassicRequest reports whether b is RFC 3489 binding request,
+// which has no magic cookie and 128-bit transaction id instead.
+func isClassicRequest(b []byte) bool {
+	if len(b) < stunHeaderSize {
+		return false
+	}
+	var (
+		t    = binary.BigEndian.Uint16(b[0:2])
+		size = int(binary.BigEndian.Uint16(b[2:4]))
+	)
+	return t == bindingRequest.Value() && stunHeaderSize+size == len(b)
+}
+
+// processClassic processes RFC 3489 binding request, responding with
+// MAPPED-ADDRESS and, if known, SOURCE-ADDRESS and CHANGED-ADDRESS.
+func processClassic(ctx *stunContext, b []byte) error {
+	req, res := ctx.req, ctx.res
+	// First 32 bits of classic transaction id are at the place of
+	// magic cookie, so they are replaced with it to decode request
+	// and then put back into response.
+	var idPrefix [4]byte
+	copy(idPrefix[:], b[4:8])
+	binary.BigEndian.PutUint32(b[4:8], magicCookie)
+	req.Raw = b
+	if err := req.Decode(); err != nil {
+		return err
+	}
+	log.Println("stun: got classic", req.Type, "from", ctx.remote)
+	clientStats.Add("classic", 1)
+	if ctx.udp.behavior {
+		switch err := ctx.change.GetFrom(req); err {
+		case nil, stun.ErrAttributeNotFound:
+		default:
+			return err
+		}
+	}
+	remote := ctx.remote.(*net.UDPAddr)
+	res.TransactionID = req.TransactionID
+	res.Type = bindingSuccessResponse
+	res.WriteHeader()
+	mapped := &stun.MappedAddress{
+		IP:   remote.IP,
+		Port: remote.Port,
+	}
+	if err := mapped.AddTo(res); err != nil {
+		return err
+	}
+	if origin := ctx.udp.origin(ctx); !origin.IP.IsUnspecified() {
+		if err := (addrAttr{
+			Type: attrSourceAddress,
+			IP:   origin.IP,
+			Port: origin.Port,
+		}).AddTo(res); err != nil {
+			return err
+		}
+	}
+	if ctx.udp.behavior {
+		changed := ctx.udp.addrs[1-ctx.ip][1-ctx.port]
+		if err := (addrAttr{
+			Type: attrChangedAddress,
+			IP:   changed.IP,
+			Port: changed.Port,
+		}).AddTo(res); err != nil {
+			return err
+		}
+	}
+	if err := software.AddTo(res); err != nil {
+		return err
+	}
+	copy(res.Raw[4:8], idPrefix[:])
+	return nil
+}
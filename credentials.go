@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// shortTermCredentials is set of username and password pairs for
+// STUN short-term credential mechanism.
+//
+// RFC 5389 Section 10.1
+type shortTermCredentials struct {
+	mux       sync.RWMutex
+	passwords map[string]string
+}
+
+var credentials = &shortTermCredentials{
+	passwords: make(map[string]string),
+}
+
+func (c *shortTermCredentials) set(username, password string) {
+	c.mux.Lock()
+	c.passwords[username] = password
+	c.mux.Unlock()
+}
+
+// password returns password for username and true if found.
+func (c *shortTermCredentials) password(username string) (string, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	p, ok := c.passwords[username]
+	return p, ok
+}
+
+var errBadCredentials = errors.New("credentials should be in user:password format")
+
+// parseCredentials parses comma-separated list of user:password pairs.
+func parseCredentials(s string) (map[string]string, error) {
+	passwords := make(map[string]string)
+	if len(s) == 0 {
+		return passwords, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		idx := strings.Index(pair, ":")
+		if idx <= 0 {
+			return nil, errBadCredentials
+		}
+		passwords[pair[:idx]] = pair[idx+1:]
+	}
+	return passwords, nil
+}
@@ -0,0 +1,109 @@
+// Command gortc-sdplint checks SDP files with lint rules.
+//
+// Usage:
+//
+//	gortc-sdplint [-json] [-disable rule,...] [file ...]
+//
+// Standard input is read if no files are provided. Exit code is 1 if
+// any problem with error severity is found.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gortc/sdp"
+
+	"github.com/gortc/web/lint"
+)
+
+var (
+	asJSON  = flag.Bool("json", false, "print problems as JSON")
+	disable = flag.String("disable", "", "comma-separated rules to disable")
+	rules   = flag.Bool("rules", false, "list rules and exit")
+)
+
+func lintFile(name string, linter lint.Linter) ([]lint.Problem, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if name == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := sdp.DecodeSession(data, nil)
+	if err != nil {
+		return nil, err
+	}
+	return linter.Lint(s), nil
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("gortc-sdplint: ")
+	disabled := make(map[string]bool)
+	for _, name := range strings.Split(*disable, ",") {
+		disabled[strings.TrimSpace(name)] = true
+	}
+	var linter lint.Linter
+	for _, r := range lint.DefaultRules {
+		if *rules {
+			fmt.Printf("%-20s %s\n", r.Name, r.Description)
+			continue
+		}
+		if !disabled[r.Name] {
+			linter.Rules = append(linter.Rules, r)
+		}
+	}
+	if *rules {
+		return
+	}
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var (
+		failed bool
+		result = make(map[string][]lint.Problem)
+	)
+	for _, name := range files {
+		problems, err := lintFile(name, linter)
+		if err != nil {
+			log.Fatalf("%s: %s", name, err)
+		}
+		result[name] = problems
+		for _, p := range problems {
+			if p.Severity == lint.Error {
+				failed = true
+			}
+			switch {
+			case *asJSON:
+			case p.Line == 0:
+				fmt.Printf("%s: %s: %s (%s)\n", name, p.Severity, p.Message, p.Rule)
+			default:
+				fmt.Printf("%s:%d: %s: %s (%s)\n", name, p.Line, p.Severity, p.Message, p.Rule)
+			}
+		}
+	}
+	if *asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if err := e.Encode(result); err != nil {
+			log.Fatalln("failed to encode:", err)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
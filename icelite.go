@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gortc/ice"
+	"github.com/gortc/sdp"
+	"github.com/gortc/stun"
+)
+
+const (
+	// iceSessionLifetime is how long ICE-lite session is kept.
+	iceSessionLifetime = time.Minute * 5
+	// iceMaxSessions limits number of ICE-lite sessions of every owner,
+	// so anonymous /x/sdp/answer sessions can't lock out WHIP and WHEP.
+	iceMaxSessions = 1000
+	// iceMaxRemoteCandidates limits trickled candidates per session.
+	iceMaxRemoteCandidates = 100
+
+	// Lengths of ice-ufrag and ice-pwd, RFC 8839 Section 5.4.
+	iceUfragLength = 8
+	icePwdLength   = 24
+)
+
+var (
+	iceStats = expvar.NewMap("ice_lite")
+
+	errTooManySessions = errors.New("too many ICE sessions")
+	errNoUfrag         = errors.New("no ice-ufrag in offer")
+	errNoSession       = errors.New("no ICE session")
+	errICERestart      = errors.New("ICE restart is not supported")
+	errTooManyRemote   = errors.New("too many remote candidates")
+	errNoCandidateIPs  = errors.New("no public-ip4, public-ip6 or explicit STUN host for candidates")
+)
+
+// icePair is candidate pair that was checked by remote agent.
+type icePair struct {
+	Local     string    `json:"local"`
+	Remote    string    `json:"remote"`
+	Priority  uint32    `json:"priority"`
+	Checks    int       `json:"checks"`
+	Nominated bool      `json:"nominated"`
+	LastCheck time.Time `json:"last_check"`
+}
+
+// iceSession is state of single ICE-lite negotiation.
+type iceSession struct {
+	LocalUfrag  string     `json:"local_ufrag"`
+	RemoteUfrag string     `json:"remote_ufrag"`
+	Candidates  []string   `json:"candidates"`
+	Pairs       []*icePair `json:"pairs"`
+	Nominated   *icePair   `json:"nominated,omitempty"`
+	Created     time.Time  `json:"created"`
+	// RemoteCandidates are trickled by remote agent, informational
+	// only, because lite agent does not perform checks.
+	RemoteCandidates []string `json:"remote_candidates,omitempty"`
+	// EndOfCandidates is true if remote agent finished trickling.
+	EndOfCandidates bool `json:"end_of_candidates,omitempty"`
+
+	localPwd string
+	// owner is path of WHIP or WHEP endpoint that created session,
+	// empty for /x/sdp/answer.
+	owner string
+}
+
+// iceLite is ICE-lite agent that answers offers and responds to
+// connectivity checks on STUN UDP sockets.
+//
+// Being lite, agent is always controlled and has only host candidates,
+// so remote agent does all checks and nomination.
+//
+// DTLS is not terminated: answers advertise setup:passive with
+// fingerprint of throwaway certificate, so only ICE connectivity can be
+// tested, and media or data channel of session never flows.
+//
+// RFC 8445 Section 2.5
+type iceLite struct {
+	// fingerprint is sha-256 fingerprint of certificate in answers,
+	// private key of certificate is discarded.
+	fingerprint string
+
+	mux      sync.RWMutex
+	sessions map[string]*iceSession // by local ufrag
+	owned    map[string]int         // number of sessions by owner
+}
+
+// iceLiteWarning is Warning header of answers, RFC 7234 Section 5.5,
+// because clients see DTLS failure only after ICE is connected.
+const iceLiteWarning = `299 - "DTLS is not terminated, only ICE connectivity is tested"`
+
+// lite is ICE-lite agent, nil if not initialized.
+var lite *iceLite
+
+// newICELite generates self-signed certificate for answers and
+// returns new ICE-lite agent.
+func newICELite() (*iceLite, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gortc.io"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 365),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return &iceLite{
+		fingerprint: strings.Join(hex, ":"),
+		sessions:    make(map[string]*iceSession),
+		owned:       make(map[string]int),
+	}, nil
+}
+
+const iceChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// randomICEString returns random string of ice-chars with length n.
+func randomICEString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = iceChars[int(b[i])%len(iceChars)]
+	}
+	return string(b)
+}
+
+// hostPriority returns priority of host candidate with local
+// preference, RFC 8445 Section 5.1.2.1.
+func hostPriority(localPreference int) int {
+	return candidatePriority(typePreferences[ice.CandidateHost], localPreference, 1)
+}
+
+// answer creates new session for offer and returns ICE-lite answer
+// with host candidates on STUN port for ips.
+//
+// If direction is empty, only data channels are accepted. Otherwise RTP
+// medias are accepted too with direction, e.g. "recvonly" for WHIP,
+// echoing offered codecs, because answer only sets up ICE. Session is
+// owned by owner, so it is modified only by endpoint that created it.
+func (l *iceLite) answer(offer sdp.Session, ips []net.IP, direction, owner string) (*iceSession, sdp.Session, error) {
+	var (
+		m       sdp.Message
+		decoder = sdp.NewDecoder(offer)
+	)
+	if err := decoder.Decode(&m); err != nil {
+		return nil, nil, err
+	}
+	remoteUfrag := m.Attribute("ice-ufrag")
+	for _, media := range m.Medias {
+		if len(remoteUfrag) > 0 {
+			break
+		}
+		remoteUfrag = media.Attribute("ice-ufrag")
+	}
+	if len(remoteUfrag) == 0 {
+		return nil, nil, errNoUfrag
+	}
+	session := &iceSession{
+		LocalUfrag:  randomICEString(iceUfragLength),
+		RemoteUfrag: remoteUfrag,
+		Created:     time.Now(),
+		localPwd:    randomICEString(icePwdLength),
+		owner:       owner,
+	}
+	for i, ip := range ips {
+		session.Candidates = append(session.Candidates, fmt.Sprintf(
+			"candidate:%d 1 udp %d %s %d typ host",
+			i+1, hostPriority(65535-i), ip, *portSTUN,
+		))
+	}
+
+	// Not accepted medias are rejected with zero port and left out
+	// of bundle.
+	accept := func(media sdp.Media) bool {
+		if media.Description.Type == "application" {
+			return true
+		}
+		return len(direction) > 0 && media.Description.Port != 0
+	}
+	var mids []string
+	for _, media := range m.Medias {
+		// Medias without mid can't be bundled.
+		if mid := media.Attribute("mid"); accept(media) && len(mid) > 0 {
+			mids = append(mids, mid)
+		}
+	}
+	s := sdp.Session{}.
+		AddVersion(0).
+		AddOrigin(sdp.Origin{
+			Username:       "-",
+			SessionID:      int(time.Now().Unix()),
+			SessionVersion: 2,
+			Address:        "127.0.0.1",
+		}).
+		AddSessionName("-").
+		AddTiming(time.Time{}, time.Time{}).
+		AddFlag("ice-lite")
+	if len(mids) > 0 {
+		s = s.AddAttribute("group", append([]string{"BUNDLE"}, mids...)...)
+	}
+	first := true
+	for _, media := range m.Medias {
+		description := media.Description
+		accepted := accept(media)
+		if !accepted {
+			description.Port = 0
+		}
+		s = s.AddMediaDescription(description).
+			AddConnectionDataIP(net.IPv4zero)
+		if mid := media.Attribute("mid"); len(mid) > 0 {
+			s = s.AddAttribute("mid", mid)
+		}
+		if !accepted {
+			s = s.AddFlag("inactive")
+			continue
+		}
+		s = s.AddAttribute("ice-ufrag", session.LocalUfrag).
+			AddAttribute("ice-pwd", session.localPwd).
+			AddAttribute("fingerprint", "sha-256", l.fingerprint).
+			AddAttribute("setup", "passive")
+		if port := media.Attribute("sctp-port"); len(port) > 0 {
+			s = s.AddAttribute("sctp-port", port)
+		}
+		if description.Type != "application" {
+			if media.Flag("inactive") {
+				s = s.AddFlag("inactive")
+			} else {
+				s = s.AddFlag(direction)
+			}
+			if media.Flag("rtcp-mux") {
+				s = s.AddFlag("rtcp-mux")
+			}
+			for _, name := range []string{"rtpmap", "fmtp", "rtcp-fb"} {
+				for _, v := range media.Attributes.Values(name) {
+					s = s.AddAttribute(name, v)
+				}
+			}
+		}
+		if first {
+			// Bundled medias share candidates of first one.
+			for _, c := range session.Candidates {
+				s = s.AddLine(sdp.TypeAttribute, c)
+			}
+			s = s.AddFlag("end-of-candidates")
+			first = false
+		}
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.owned[owner] >= iceMaxSessions {
+		return nil, nil, errTooManySessions
+	}
+	l.sessions[session.LocalUfrag] = session
+	l.owned[owner]++
+	iceStats.Add("sessions", 1)
+	log.Printf("ice: created session %s for remote ufrag %s", session.LocalUfrag, remoteUfrag)
+	return session, s, nil
+}
+
+// encodeSDP encodes session with CRLF line endings, as required
+// by RFC 4566 Section 5.
+func encodeSDP(s sdp.Session) []byte {
+	var b []byte
+	for _, l := range s {
+		b = l.AppendTo(b)
+		b = append(b, '\r', '\n')
+	}
+	return b
+}
+
+// password returns password for username of connectivity check, which
+// is "localUfrag:remoteUfrag", and true if session is found.
+//
+// RFC 8445 Section 7.2.2
+func (l *iceLite) password(username string) (string, bool) {
+	idx := strings.Index(username, ":")
+	if idx <= 0 {
+		return "", false
+	}
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+	s, ok := l.sessions[username[:idx]]
+	if !ok || s.RemoteUfrag != username[idx+1:] {
+		return "", false
+	}
+	return s.localPwd, true
+}
+
+// snapshot returns copy of state of session for ufrag that is owned by
+// owner or nil.
+func (l *iceLite) snapshot(owner, ufrag string) *iceSession {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+	s, ok := l.sessions[ufrag]
+	if !ok || s.owner != owner {
+		return nil
+	}
+	c := *s
+	c.RemoteCandidates = append([]string(nil), s.RemoteCandidates...)
+	c.Pairs = make([]*icePair, len(s.Pairs))
+	for i, p := range s.Pairs {
+		pair := *p
+		c.Pairs[i] = &pair
+		if p == s.Nominated {
+			c.Nominated = &pair
+		}
+	}
+	return &c
+}
+
+// check records authenticated connectivity check from ctx, updating
+// candidate pairs and nomination of session.
+func (l *iceLite) check(ctx *stunContext) {
+	var username stun.Username
+	if err := username.GetFrom(ctx.req); err != nil {
+		return
+	}
+	idx := strings.Index(username.String(), ":")
+	if idx <= 0 {
+		return
+	}
+	var priority ice.Priority
+	if err := priority.GetFrom(ctx.req); err != nil {
+		// Not a connectivity check, e.g. request with static credentials.
+		return
+	}
+	var (
+		ufrag     = username.String()[:idx]
+		nominated = ice.UseCandidate.IsSet(ctx.req)
+		remote    = ctx.remote.String()
+	)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	s, ok := l.sessions[ufrag]
+	if !ok {
+		return
+	}
+	iceStats.Add("checks", 1)
+	var pair *icePair
+	for _, p := range s.Pairs {
+		if p.Remote == remote {
+			pair = p
+			break
+		}
+	}
+	if pair == nil {
+		pair = &icePair{
+			Local:  s.localAddr(ctx),
+			Remote: remote,
+		}
+		s.Pairs = append(s.Pairs, pair)
+	}
+	pair.Priority = uint32(priority)
+	pair.Checks++
+	pair.LastCheck = time.Now()
+	if nominated && !pair.Nominated {
+		pair.Nominated = true
+		s.Nominated = pair
+		iceStats.Add("nominated", 1)
+		log.Printf("ice: session %s nominated %s <-> %s", ufrag, pair.Local, pair.Remote)
+	}
+}
+
+// localAddr returns address of host candidate that received check,
+// falling back to address of receiving socket.
+func (s *iceSession) localAddr(ctx *stunContext) string {
+	ip := ctx.remote.(*net.UDPAddr).IP
+	for _, c := range s.Candidates {
+		fields := strings.Fields(c)
+		if len(fields) < 6 {
+			continue
+		}
+		candidateIP := net.ParseIP(fields[4])
+		if candidateIP == nil || (candidateIP.To4() == nil) != (ip.To4() == nil) {
+			continue
+		}
+		return net.JoinHostPort(fields[4], fields[5])
+	}
+	return ctx.local.String()
+}
+
+// trickle adds remote candidates from SDP fragment to session for ufrag
+// that is owned by owner, RFC 8840 Section 4.4.
+//
+// Returns errICERestart if fragment has ice-ufrag of other session.
+func (l *iceLite) trickle(owner, ufrag string, frag sdp.Session) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	s, ok := l.sessions[ufrag]
+	if !ok || s.owner != owner {
+		return errNoSession
+	}
+	var (
+		candidates []string
+		ended      bool
+	)
+	for _, line := range frag {
+		if line.Type != sdp.TypeAttribute {
+			continue
+		}
+		v := string(line.Value)
+		switch {
+		case strings.HasPrefix(v, "ice-ufrag:"):
+			if strings.TrimPrefix(v, "ice-ufrag:") != s.RemoteUfrag {
+				return errICERestart
+			}
+		case strings.HasPrefix(v, "candidate:"):
+			var c ice.Candidate
+			if err := ice.ParseAttribute(line.Value, &c); err != nil {
+				return err
+			}
+			candidates = append(candidates, v)
+		case v == "end-of-candidates":
+			ended = true
+		}
+	}
+	if len(s.RemoteCandidates)+len(candidates) > iceMaxRemoteCandidates {
+		return errTooManyRemote
+	}
+	s.RemoteCandidates = append(s.RemoteCandidates, candidates...)
+	s.EndOfCandidates = s.EndOfCandidates || ended
+	iceStats.Add("trickled", int64(len(candidates)))
+	return nil
+}
+
+// remove deletes session for ufrag that is owned by owner, returning
+// false if not found.
+func (l *iceLite) remove(owner, ufrag string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if s, ok := l.sessions[ufrag]; !ok || s.owner != owner {
+		return false
+	}
+	l.delete(ufrag)
+	log.Println("ice: removed session", ufrag)
+	return true
+}
+
+// delete deletes session for ufrag, l.mux should be locked.
+func (l *iceLite) delete(ufrag string) {
+	l.owned[l.sessions[ufrag].owner]--
+	delete(l.sessions, ufrag)
+}
+
+func (l *iceLite) collect() {
+	timeout := time.Now().Add(-iceSessionLifetime)
+	l.mux.Lock()
+	collected := 0
+	for ufrag, s := range l.sessions {
+		if s.Created.Before(timeout) {
+			l.delete(ufrag)
+			collected++
+		}
+	}
+	l.mux.Unlock()
+	if collected > 0 {
+		log.Println("ice: collected", collected, "sessions")
+	}
+}
+
+func (l *iceLite) gc() {
+	ticker := time.NewTicker(time.Second * 5)
+	for range ticker.C {
+		l.collect()
+	}
+}
+
+// candidateIPs returns addresses of host candidates for answer: public
+// addresses if set, explicit STUN hosts otherwise. Local address of
+// HTTP request is not used, because it is loopback behind proxy.
+func candidateIPs() ([]net.IP, error) {
+	var ips []net.IP
+	for _, hosts := range [][]string{
+		{*publicIPv4, *publicIPv6},
+		{*hostSTUN, *hostSTUN6},
+	} {
+		for _, h := range hosts {
+			if ip := net.ParseIP(h); ip != nil && !ip.IsUnspecified() {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) > 0 {
+			return ips, nil
+		}
+	}
+	return nil, errNoCandidateIPs
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gortc/ice"
+	"github.com/gortc/sdp"
+	"github.com/gortc/stun"
+)
+
+// testOffer has data channel, audio without mid and video.
+var testOffer = []string{
+	"v=0",
+	"o=- 1 2 IN IP4 127.0.0.1",
+	"s=-",
+	"t=0 0",
+	"a=ice-ufrag:remote",
+	"a=ice-pwd:" + strings.Repeat("p", 22),
+	"m=application 9 UDP/DTLS/SCTP webrtc-datachannel",
+	"c=IN IP4 0.0.0.0",
+	"a=mid:0",
+	"a=sctp-port:5000",
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+	"c=IN IP4 0.0.0.0",
+	"a=rtpmap:111 opus/48000/2",
+	"m=video 9 UDP/TLS/RTP/SAVPF 96",
+	"c=IN IP4 0.0.0.0",
+	"a=mid:2",
+	"a=rtpmap:96 VP8/90000",
+}
+
+func decodeTestSDP(t *testing.T, lines []string) sdp.Session {
+	t.Helper()
+	s, err := sdp.DecodeSession([]byte(strings.Join(lines, "\r\n")+"\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestICELite(t *testing.T) *iceLite {
+	t.Helper()
+	l, err := newICELite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+var testCandidateIPs = []net.IP{net.IPv4(192, 0, 2, 1)}
+
+func TestICELiteAnswer(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tc := range []struct {
+		name      string
+		direction string
+		bundle    string
+		// inactive is number of rejected medias.
+		inactive int
+	}{
+		{"DataChannel", "", "a=group:BUNDLE 0", 2},
+		// Audio is accepted, but is not bundled without mid.
+		{"Media", "recvonly", "a=group:BUNDLE 0 2", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newTestICELite(t)
+			session, answer, err := l.answer(decodeTestSDP(t, testOffer), testCandidateIPs, tc.direction, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if session.RemoteUfrag != "remote" {
+				t.Errorf("remote ufrag %q", session.RemoteUfrag)
+			}
+			var (
+				lines    = strings.Split(strings.TrimSpace(string(encodeSDP(answer))), "\r\n")
+				groups   []string
+				inactive int
+			)
+			for _, line := range lines {
+				switch {
+				case strings.HasPrefix(line, "a=group:"):
+					groups = append(groups, line)
+				case strings.HasPrefix(line, "m=") && strings.Contains(line, " 0 "):
+					inactive++
+				}
+			}
+			if len(groups) != 1 || groups[0] != tc.bundle {
+				t.Errorf("got groups %q, want %q", groups, tc.bundle)
+			}
+			if inactive != tc.inactive {
+				t.Errorf("%d rejected medias, want %d", inactive, tc.inactive)
+			}
+			if _, err = sdp.DecodeSession(encodeSDP(answer), nil); err != nil {
+				t.Errorf("failed to decode answer: %v", err)
+			}
+		})
+	}
+}
+
+func TestICELiteSessionLimit(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	var (
+		l     = newTestICELite(t)
+		offer = decodeTestSDP(t, testOffer)
+		first *iceSession
+	)
+	for i := 0; i < iceMaxSessions; i++ {
+		s, _, err := l.answer(offer, testCandidateIPs, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = s
+		}
+	}
+	if _, _, err := l.answer(offer, testCandidateIPs, "", ""); err != errTooManySessions {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// Sessions of other owners have own limit.
+	s, _, err := l.answer(offer, testCandidateIPs, "recvonly", "/whip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.remove("", s.LocalUfrag) {
+		t.Error("session is removed by other owner")
+	}
+	if !l.remove("", first.LocalUfrag) {
+		t.Fatal("session is not removed")
+	}
+	if _, _, err := l.answer(offer, testCandidateIPs, "", ""); err != nil {
+		t.Errorf("unexpected error %v after remove", err)
+	}
+}
+
+func TestICELitePassword(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	l := newTestICELite(t)
+	s, _, err := l.answer(decodeTestSDP(t, testOffer), testCandidateIPs, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		username string
+		ok       bool
+	}{
+		{s.LocalUfrag + ":remote", true},
+		{s.LocalUfrag + ":other", false},
+		{s.LocalUfrag + ":", false},
+		{s.LocalUfrag, false},
+		{":remote", false},
+		{"unknown:remote", false},
+		{"remote:" + s.LocalUfrag, false},
+	} {
+		password, ok := l.password(tc.username)
+		if ok != tc.ok {
+			t.Errorf("password(%q) found = %v, want %v", tc.username, ok, tc.ok)
+		}
+		if ok && password != s.localPwd {
+			t.Errorf("password(%q) = %q", tc.username, password)
+		}
+	}
+}
+
+func TestICELiteCheck(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(l *iceLite) { lite = l }(lite)
+	lite = newTestICELite(t)
+	s, _, err := lite.answer(decodeTestSDP(t, testOffer), testCandidateIPs, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		username = stun.NewUsername(s.LocalUfrag + ":remote")
+		priority = ice.Priority(1853824767)
+		u        = &udpServer{}
+	)
+	check := func(password string, setters ...stun.Setter) *stun.Message {
+		t.Helper()
+		setters = append([]stun.Setter{stun.TransactionID, stun.BindingRequest, username, priority}, setters...)
+		setters = append(setters, stun.NewShortTermIntegrity(password), stun.Fingerprint)
+		res := processRequest(t, u, stun.MustBuild(setters...))
+		if res == nil {
+			t.Fatal("no response")
+		}
+		return res
+	}
+
+	res := check(strings.Repeat("x", icePwdLength))
+	if code := errorCode(t, res); code != stun.CodeUnauthorised {
+		t.Errorf("got code %d for bad password", code)
+	}
+	if got := lite.snapshot("", s.LocalUfrag); len(got.Pairs) != 0 {
+		t.Errorf("pair is added by failed check: %+v", got.Pairs[0])
+	}
+
+	res = check(s.localPwd)
+	if code := errorCode(t, res); code != 0 {
+		t.Fatalf("got code %d", code)
+	}
+	// Response is signed with local password.
+	if err = stun.NewShortTermIntegrity(s.localPwd).Check(res); err != nil {
+		t.Errorf("bad response integrity: %v", err)
+	}
+	got := lite.snapshot("", s.LocalUfrag)
+	if len(got.Pairs) != 1 || got.Nominated != nil {
+		t.Fatalf("unexpected pairs %+v", got.Pairs)
+	}
+	pair := got.Pairs[0]
+	if pair.Local != "192.0.2.1:"+strconv.Itoa(*portSTUN) || pair.Remote != "127.0.0.1:5000" {
+		t.Errorf("unexpected pair %s <-> %s", pair.Local, pair.Remote)
+	}
+	if pair.Priority != uint32(priority) || pair.Checks != 1 {
+		t.Errorf("unexpected pair priority %d or checks %d", pair.Priority, pair.Checks)
+	}
+
+	if code := errorCode(t, check(s.localPwd, ice.UseCandidate)); code != 0 {
+		t.Fatalf("got code %d", code)
+	}
+	got = lite.snapshot("", s.LocalUfrag)
+	if len(got.Pairs) != 1 || got.Nominated == nil || !got.Nominated.Nominated {
+		t.Fatalf("pair is not nominated: %+v", got.Pairs)
+	}
+	if got.Nominated.Checks != 2 {
+		t.Errorf("%d checks", got.Nominated.Checks)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Prefix lengths of subnets that share single rate limit.
+const (
+	subnetBitsIPv4 = 24
+	subnetBitsIPv6 = 64
+)
+
+const limiterIdleTimeout = time.Minute
+
+var limiterStats = expvar.NewMap("stun_limiter")
+
+// limiter is used by STUN servers, initialized from flags.
+var limiter = newRateLimiter(0, 0, 0)
+
+type limiterEntry struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+// limiterGroup is set of token buckets indexed by key.
+type limiterGroup struct {
+	limit   rate.Limit
+	burst   int
+	entries map[string]*limiterEntry
+}
+
+func newLimiterGroup(perSecond int) limiterGroup {
+	return limiterGroup{
+		limit:   limitFor(perSecond),
+		burst:   burstFor(perSecond),
+		entries: make(map[string]*limiterEntry),
+	}
+}
+
+func (g limiterGroup) allow(key string, now time.Time) bool {
+	if g.limit == rate.Inf {
+		return true
+	}
+	e := g.entries[key]
+	if e == nil {
+		e = &limiterEntry{Limiter: rate.NewLimiter(g.limit, g.burst)}
+		g.entries[key] = e
+	}
+	e.lastSeen = now
+	return e.AllowN(now, 1)
+}
+
+func (g limiterGroup) collect(timeout time.Time) {
+	for k, e := range g.entries {
+		if e.lastSeen.Before(timeout) {
+			delete(g.entries, k)
+		}
+	}
+}
+
+// limitFor returns rate limit for packets per second value, where zero
+// means no limit.
+func limitFor(perSecond int) rate.Limit {
+	if perSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(perSecond)
+}
+
+func burstFor(perSecond int) int {
+	if perSecond <= 0 {
+		return 1
+	}
+	return perSecond
+}
+
+// rateLimiter limits incoming packets with token buckets per source
+// IP and per source subnet, along with global packet budget.
+// Over-limit packets should be dropped without response to prevent
+// the server being used for reflection.
+type rateLimiter struct {
+	global *rate.Limiter
+
+	mux     sync.Mutex
+	ips     limiterGroup
+	subnets limiterGroup
+}
+
+func newRateLimiter(perIP, perSubnet, global int) *rateLimiter {
+	return &rateLimiter{
+		global:  rate.NewLimiter(limitFor(global), burstFor(global)),
+		ips:     newLimiterGroup(perIP),
+		subnets: newLimiterGroup(perSubnet),
+	}
+}
+
+func subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(subnetBitsIPv4, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(subnetBitsIPv6, 128)).String()
+}
+
+// allow reports whether packet from ip should be processed.
+func (l *rateLimiter) allow(ip net.IP) bool {
+	now := time.Now()
+	l.mux.Lock()
+	var (
+		ipAllowed     = l.ips.allow(ip.String(), now)
+		subnetAllowed = l.subnets.allow(subnet(ip), now)
+	)
+	l.mux.Unlock()
+	switch {
+	case !ipAllowed:
+		limiterStats.Add("dropped_ip", 1)
+	case !subnetAllowed:
+		limiterStats.Add("dropped_subnet", 1)
+	case !l.global.AllowN(now, 1):
+		limiterStats.Add("dropped_global", 1)
+	default:
+		limiterStats.Add("allowed", 1)
+		return true
+	}
+	return false
+}
+
+func (l *rateLimiter) collect() {
+	timeout := time.Now().Add(-limiterIdleTimeout)
+	l.mux.Lock()
+	l.ips.collect(timeout)
+	l.subnets.collect(timeout)
+	l.mux.Unlock()
+}
+
+func (l *rateLimiter) gc() {
+	ticker := time.NewTicker(time.Second * 10)
+	for range ticker.C {
+		l.collect()
+	}
+}
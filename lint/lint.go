@@ -0,0 +1,168 @@
+// Package lint implements rule-based validation of SDP.
+//
+// Rules are checked against decoded sdp.Session, so every problem can
+// be reported with number of offending line. Rule set is extensible:
+// custom rules can be appended to Linter.Rules along with DefaultRules.
+package lint
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/gortc/sdp"
+)
+
+// Severity of problem.
+type Severity byte
+
+// Possible severities.
+const (
+	Info Severity = iota
+	Warning
+	Error
+)
+
+var severities = map[Severity]string{
+	Info:    "info",
+	Warning: "warning",
+	Error:   "error",
+}
+
+func (s Severity) String() string {
+	if v, ok := severities[s]; ok {
+		return v
+	}
+	return fmt.Sprintf("severity(%d)", byte(s))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Problem is single rule violation.
+type Problem struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	// Line is 1-based number of offending line, zero if problem is
+	// not related to single line, e.g. missing line.
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s (%s)", p.Severity, p.Message, p.Rule)
+	}
+	return fmt.Sprintf("line %d: %s: %s (%s)", p.Line, p.Severity, p.Message, p.Rule)
+}
+
+// Section is session-level part or media description of SDP.
+type Section struct {
+	// Media is index of media description, -1 for session-level part.
+	Media int
+	// Lines is section lines, starting from m= for media description.
+	Lines sdp.Session
+	// Offset is index of first section line in session.
+	Offset int
+}
+
+// Attributes returns values of all a= lines with name and their
+// indexes in session. Value is empty for flags.
+func (s Section) Attributes(name string) (values []string, indexes []int) {
+	for i, l := range s.Lines {
+		if l.Type != sdp.TypeAttribute {
+			continue
+		}
+		k, v := Attribute(l.Value)
+		if k == name {
+			values = append(values, v)
+			indexes = append(indexes, s.Offset+i)
+		}
+	}
+	return values, indexes
+}
+
+// Attribute splits value of a= line into name and value.
+func Attribute(v []byte) (name, value string) {
+	idx := bytes.IndexByte(v, ':')
+	if idx < 0 {
+		return string(v), ""
+	}
+	return string(v[:idx]), string(v[idx+1:])
+}
+
+// Context is state of single linter run, passed to every rule.
+type Context struct {
+	Session sdp.Session
+	// Sections is session-level part followed by media descriptions.
+	Sections []Section
+
+	rule     Rule
+	problems []Problem
+}
+
+func newContext(s sdp.Session) *Context {
+	c := &Context{
+		Session:  s,
+		Sections: []Section{{Media: -1}},
+	}
+	for i, l := range s {
+		if l.Type == sdp.TypeMediaDescription {
+			c.Sections = append(c.Sections, Section{
+				Media:  len(c.Sections) - 1,
+				Offset: i,
+			})
+		}
+		last := &c.Sections[len(c.Sections)-1]
+		last.Lines = append(last.Lines, l)
+	}
+	return c
+}
+
+// Medias returns media description sections.
+func (c *Context) Medias() []Section {
+	return c.Sections[1:]
+}
+
+// Report adds problem found at line index i of session, or not related
+// to any line if i is negative.
+func (c *Context) Report(severity Severity, i int, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{
+		Rule:     c.rule.Name,
+		Severity: severity,
+		Line:     i + 1,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Rule is named check of SDP.
+type Rule struct {
+	Name        string
+	Description string
+	Check       func(c *Context)
+}
+
+// Linter checks SDP with set of rules.
+type Linter struct {
+	Rules []Rule
+}
+
+// Lint returns problems found by all rules, ordered by line.
+func (l Linter) Lint(s sdp.Session) []Problem {
+	c := newContext(s)
+	for _, r := range l.Rules {
+		c.rule = r
+		r.Check(c)
+	}
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		return c.problems[i].Line < c.problems[j].Line
+	})
+	return c.problems
+}
+
+// Lint returns problems found by DefaultRules.
+func Lint(s sdp.Session) []Problem {
+	return Linter{Rules: DefaultRules}.Lint(s)
+}
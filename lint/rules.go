@@ -0,0 +1,234 @@
+package lint
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gortc/ice"
+	"github.com/gortc/sdp"
+)
+
+// DefaultRules is rule set used by Lint.
+var DefaultRules = []Rule{
+	{
+		Name:        "required-lines",
+		Description: "v=, o=, s= and t= lines are present once, RFC 4566 Section 5",
+		Check:       checkRequiredLines,
+	},
+	{
+		Name:        "bundle-mids",
+		Description: "mids of a=group:BUNDLE are unique and known, RFC 8843",
+		Check:       checkBundleMids,
+	},
+	{
+		Name:        "ice-credentials",
+		Description: "ice-ufrag and ice-pwd lengths and characters, RFC 8839 Section 5.4",
+		Check:       checkICECredentials,
+	},
+	{
+		Name:        "fingerprint-hash",
+		Description: "fingerprint hash function is supported, RFC 8122 Section 5",
+		Check:       checkFingerprintHash,
+	},
+	{
+		Name:        "rtpmap",
+		Description: "dynamic payload types have rtpmap, RFC 4566 Section 6",
+		Check:       checkRTPMap,
+	},
+	{
+		Name:        "candidate-priority",
+		Description: "candidates are valid and priority is in [1, 2^31-1], RFC 8839 Section 5.1",
+		Check:       checkCandidatePriority,
+	},
+}
+
+func checkRequiredLines(c *Context) {
+	session := c.Sections[0]
+	if len(session.Lines) == 0 || session.Lines[0].Type != sdp.TypeProtocolVersion {
+		c.Report(Error, 0, "first line is not v=")
+	}
+	for _, t := range []sdp.Type{
+		sdp.TypeProtocolVersion, sdp.TypeOrigin, sdp.TypeSessionName, sdp.TypeTiming,
+	} {
+		var found []int
+		for i, l := range session.Lines {
+			if l.Type == t {
+				found = append(found, i)
+			}
+		}
+		switch {
+		case len(found) == 0:
+			c.Report(Error, -1, "missing %c= line", rune(t))
+		case len(found) > 1 && t != sdp.TypeTiming:
+			// Multiple time descriptions are allowed.
+			for _, i := range found[1:] {
+				c.Report(Error, i, "duplicate %c= line", rune(t))
+			}
+		}
+	}
+}
+
+func checkBundleMids(c *Context) {
+	mids := make(map[string]bool)
+	for _, m := range c.Medias() {
+		values, indexes := m.Attributes("mid")
+		for k, mid := range values {
+			if mids[mid] {
+				c.Report(Error, indexes[k], "duplicate mid %q", mid)
+			}
+			mids[mid] = true
+		}
+	}
+	groups, indexes := c.Sections[0].Attributes("group")
+	for k, v := range groups {
+		fields := strings.Fields(v)
+		if len(fields) == 0 || fields[0] != "BUNDLE" {
+			continue
+		}
+		if len(fields) == 1 {
+			c.Report(Warning, indexes[k], "empty BUNDLE group")
+		}
+		for _, mid := range fields[1:] {
+			if !mids[mid] {
+				c.Report(Error, indexes[k], "BUNDLE references unknown mid %q", mid)
+			}
+		}
+	}
+}
+
+func isICEChar(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+		r == '+' || r == '/'
+}
+
+func checkICECredentials(c *Context) {
+	for _, limit := range []struct {
+		name     string
+		min, max int
+	}{
+		{name: "ice-ufrag", min: 4, max: 256},
+		{name: "ice-pwd", min: 22, max: 256},
+	} {
+		for _, s := range c.Sections {
+			values, indexes := s.Attributes(limit.name)
+			for k, v := range values {
+				if len(v) < limit.min || len(v) > limit.max {
+					c.Report(Error, indexes[k], "%s length %d is not in [%d, %d]",
+						limit.name, len(v), limit.min, limit.max,
+					)
+				}
+				if strings.IndexFunc(v, func(r rune) bool { return !isICEChar(r) }) >= 0 {
+					c.Report(Error, indexes[k], "%s has characters other than ALPHA, DIGIT, + and /", limit.name)
+				}
+			}
+		}
+	}
+}
+
+// fingerprintHashes are hash functions from RFC 8122 with digest sizes.
+var fingerprintHashes = map[string]int{
+	"sha-1":   20,
+	"sha-224": 28,
+	"sha-256": 32,
+	"sha-384": 48,
+	"sha-512": 64,
+	"md5":     16,
+	"md2":     16,
+}
+
+func checkFingerprintHash(c *Context) {
+	for _, s := range c.Sections {
+		values, indexes := s.Attributes("fingerprint")
+		for k, v := range values {
+			i := indexes[k]
+			hash, digest := v, ""
+			if idx := strings.IndexByte(v, ' '); idx >= 0 {
+				hash, digest = v[:idx], strings.TrimSpace(v[idx+1:])
+			}
+			hash = strings.ToLower(hash)
+			size, ok := fingerprintHashes[hash]
+			switch {
+			case !ok:
+				c.Report(Error, i, "unsupported fingerprint hash %q", hash)
+				continue
+			case hash == "md5" || hash == "md2":
+				c.Report(Error, i, "fingerprint hash %s must not be used", hash)
+			case hash == "sha-1":
+				c.Report(Warning, i, "fingerprint hash sha-1 is weak, sha-256 is preferred")
+			}
+			if n := len(strings.Split(digest, ":")); len(digest) == 0 || n != size {
+				c.Report(Error, i, "%s fingerprint should have %d bytes", hash, size)
+			}
+		}
+	}
+}
+
+// Range of dynamic RTP payload types, RFC 3551 Section 6. Static ones
+// do not require rtpmap.
+const (
+	dynamicPayloadTypes = 96
+	maxPayloadType      = 127
+)
+
+func checkRTPMap(c *Context) {
+	for _, m := range c.Medias() {
+		// <media> <port> <proto> <fmt> ...
+		fields := strings.Fields(string(m.Lines[0].Value))
+		if len(fields) < 3 || !strings.Contains(fields[2], "RTP") {
+			continue
+		}
+		formats := make(map[string]bool)
+		for _, f := range fields[3:] {
+			formats[f] = true
+			pt, err := strconv.Atoi(f)
+			if err != nil || pt < 0 || pt > maxPayloadType {
+				c.Report(Error, m.Offset, "bad payload type %q", f)
+			}
+		}
+		mapped := make(map[string]bool)
+		values, indexes := m.Attributes("rtpmap")
+		for k, v := range values {
+			pt := strings.Fields(v)
+			if len(pt) == 0 {
+				c.Report(Error, indexes[k], "empty rtpmap")
+				continue
+			}
+			mapped[pt[0]] = true
+			if !formats[pt[0]] {
+				c.Report(Warning, indexes[k], "rtpmap for payload type %s not in m= line", pt[0])
+			}
+		}
+		for _, f := range fields[3:] {
+			pt, err := strconv.Atoi(f)
+			// Bad payload types are already reported.
+			if err != nil || pt < dynamicPayloadTypes || pt > maxPayloadType || mapped[f] {
+				continue
+			}
+			c.Report(Error, m.Offset, "payload type %s has no rtpmap", f)
+		}
+	}
+}
+
+// maxCandidatePriority is 2^31-1.
+const maxCandidatePriority = 1<<31 - 1
+
+func checkCandidatePriority(c *Context) {
+	for _, s := range c.Sections {
+		for i, l := range s.Lines {
+			if l.Type != sdp.TypeAttribute {
+				continue
+			}
+			if name, _ := Attribute(l.Value); name != "candidate" {
+				continue
+			}
+			var candidate ice.Candidate
+			if err := ice.ParseAttribute(l.Value, &candidate); err != nil {
+				c.Report(Error, s.Offset+i, "failed to parse candidate: %s", err)
+				continue
+			}
+			if candidate.Priority < 1 || candidate.Priority > maxCandidatePriority {
+				c.Report(Error, s.Offset+i, "candidate priority %d is not in [1, 2^31-1]", candidate.Priority)
+			}
+		}
+	}
+}
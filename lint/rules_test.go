@@ -0,0 +1,256 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gortc/sdp"
+)
+
+// sessionLines are lines 1-4 of every test session, other lines are
+// appended starting from line 5.
+var sessionLines = []string{
+	"v=0",
+	"o=- 1 2 IN IP4 127.0.0.1",
+	"s=-",
+	"t=0 0",
+}
+
+func ruleByName(t *testing.T, name string) Rule {
+	t.Helper()
+	for _, r := range DefaultRules {
+		if r.Name == name {
+			return r
+		}
+	}
+	t.Fatalf("no rule %q", name)
+	return Rule{}
+}
+
+func decodeLines(t *testing.T, lines []string) sdp.Session {
+	t.Helper()
+	s, err := sdp.DecodeSession([]byte(strings.Join(lines, "\r\n")+"\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDefaultRules(t *testing.T) {
+	// ufrag and pwd have maximum length of 256.
+	long := strings.Repeat("a", 257)
+	for _, tc := range []struct {
+		rule string
+		name string
+		// lines replace sessionLines if raw is true.
+		lines []string
+		raw   bool
+		want  []Problem
+	}{
+		{
+			rule: "required-lines", name: "Valid",
+		},
+		{
+			rule: "required-lines", name: "Missing",
+			lines: []string{"v=0", "o=- 1 2 IN IP4 127.0.0.1", "t=0 0"}, raw: true,
+			want: []Problem{{Severity: Error, Line: 0}},
+		},
+		{
+			rule: "required-lines", name: "Duplicate",
+			lines: []string{"v=0", "o=- 1 2 IN IP4 127.0.0.1", "s=-", "o=- 1 2 IN IP4 127.0.0.1", "t=0 0", "t=1 2"}, raw: true,
+			want: []Problem{{Severity: Error, Line: 4}},
+		},
+		{
+			rule: "required-lines", name: "NotFirstVersion",
+			lines: []string{"o=- 1 2 IN IP4 127.0.0.1", "v=0", "s=-", "t=0 0"}, raw: true,
+			want: []Problem{{Severity: Error, Line: 1}},
+		},
+		{
+			rule: "bundle-mids", name: "Valid",
+			lines: []string{
+				"a=group:BUNDLE 0 1",
+				"m=audio 9 UDP/TLS/RTP/SAVPF 0",
+				"a=mid:0",
+				"m=video 9 UDP/TLS/RTP/SAVPF 0",
+				"a=mid:1",
+			},
+		},
+		{
+			rule: "bundle-mids", name: "UnknownMid",
+			lines: []string{
+				"a=group:BUNDLE 0 1",
+				"m=audio 9 UDP/TLS/RTP/SAVPF 0",
+				"a=mid:0",
+			},
+			want: []Problem{{Severity: Error, Line: 5}},
+		},
+		{
+			rule: "bundle-mids", name: "DuplicateMid",
+			lines: []string{
+				"a=group:BUNDLE 0",
+				"m=audio 9 UDP/TLS/RTP/SAVPF 0",
+				"a=mid:0",
+				"m=video 9 UDP/TLS/RTP/SAVPF 0",
+				"a=mid:0",
+			},
+			want: []Problem{{Severity: Error, Line: 9}},
+		},
+		{
+			rule: "bundle-mids", name: "Empty",
+			lines: []string{"a=group:BUNDLE"},
+			want:  []Problem{{Severity: Warning, Line: 5}},
+		},
+		{
+			rule: "ice-credentials", name: "Valid",
+			lines: []string{"a=ice-ufrag:abcd", "a=ice-pwd:" + strings.Repeat("a", 22)},
+		},
+		{
+			rule: "ice-credentials", name: "MaxLength",
+			lines: []string{"a=ice-ufrag:" + long[1:], "a=ice-pwd:" + long[1:]},
+		},
+		{
+			rule: "ice-credentials", name: "UfragShort",
+			lines: []string{"a=ice-ufrag:abc"},
+			want:  []Problem{{Severity: Error, Line: 5}},
+		},
+		{
+			rule: "ice-credentials", name: "UfragLong",
+			lines: []string{"a=ice-ufrag:" + long},
+			want:  []Problem{{Severity: Error, Line: 5}},
+		},
+		{
+			rule: "ice-credentials", name: "UfragChars",
+			lines: []string{"a=ice-ufrag:ab-cd"},
+			want:  []Problem{{Severity: Error, Line: 5}},
+		},
+		{
+			rule: "ice-credentials", name: "PwdShort",
+			lines: []string{"a=ice-pwd:" + strings.Repeat("a", 21)},
+			want:  []Problem{{Severity: Error, Line: 5}},
+		},
+		{
+			rule: "ice-credentials", name: "PwdLongInMedia",
+			lines: []string{"m=audio 9 UDP/TLS/RTP/SAVPF 0", "a=ice-pwd:" + long},
+			want:  []Problem{{Severity: Error, Line: 6}},
+		},
+		{
+			rule: "fingerprint-hash", name: "SHA256",
+			lines: []string{"a=fingerprint:sha-256 " + fingerprint(32)},
+		},
+		{
+			rule: "fingerprint-hash", name: "MD5",
+			lines: []string{"a=fingerprint:md5 " + fingerprint(16)},
+			want:  []Problem{{Severity: Error, Line: 5}},
+		},
+		{
+			rule: "fingerprint-hash", name: "SHA1",
+			lines: []string{"a=fingerprint:SHA-1 " + fingerprint(20)},
+			want:  []Problem{{Severity: Warning, Line: 5}},
+		},
+		{
+			rule: "fingerprint-hash", name: "Unsupported",
+			lines: []string{"a=fingerprint:sha-3 " + fingerprint(32)},
+			want:  []Problem{{Severity: Error, Line: 5}},
+		},
+		{
+			rule: "fingerprint-hash", name: "DigestSize",
+			lines: []string{"m=audio 9 UDP/TLS/RTP/SAVPF 0", "a=fingerprint:sha-256 " + fingerprint(20)},
+			want:  []Problem{{Severity: Error, Line: 6}},
+		},
+		{
+			rule: "rtpmap", name: "Valid",
+			lines: []string{"m=audio 9 UDP/TLS/RTP/SAVPF 111 0", "a=rtpmap:111 opus/48000/2"},
+		},
+		{
+			rule: "rtpmap", name: "DataChannel",
+			lines: []string{"m=application 9 UDP/DTLS/SCTP webrtc-datachannel"},
+		},
+		{
+			rule: "rtpmap", name: "DynamicWithoutRTPMap",
+			lines: []string{
+				"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+				"a=rtpmap:111 opus/48000/2",
+				"m=video 9 UDP/TLS/RTP/SAVPF 96 97",
+				"a=rtpmap:96 VP8/90000",
+			},
+			want: []Problem{{Severity: Error, Line: 7}},
+		},
+		{
+			rule: "rtpmap", name: "NotInMediaLine",
+			lines: []string{"m=audio 9 UDP/TLS/RTP/SAVPF 0", "a=rtpmap:111 opus/48000/2"},
+			want:  []Problem{{Severity: Warning, Line: 6}},
+		},
+		{
+			rule: "rtpmap", name: "BadPayloadType",
+			lines: []string{"m=audio 9 UDP/TLS/RTP/SAVPF 128"},
+			want:  []Problem{{Severity: Error, Line: 5}},
+		},
+		{
+			rule: "candidate-priority", name: "Valid",
+			lines: []string{
+				"m=audio 9 UDP/TLS/RTP/SAVPF 0",
+				"a=candidate:1 1 udp 1 192.0.2.1 3478 typ host",
+				"a=candidate:1 1 udp 2147483647 192.0.2.1 3478 typ host",
+			},
+		},
+		{
+			rule: "candidate-priority", name: "Zero",
+			lines: []string{
+				"m=audio 9 UDP/TLS/RTP/SAVPF 0",
+				"a=candidate:1 1 udp 0 192.0.2.1 3478 typ host",
+			},
+			want: []Problem{{Severity: Error, Line: 6}},
+		},
+		{
+			rule: "candidate-priority", name: "OutOfRange",
+			lines: []string{"a=candidate:1 1 udp 2147483648 192.0.2.1 3478 typ host"},
+			want:  []Problem{{Severity: Error, Line: 5}},
+		},
+		{
+			rule: "candidate-priority", name: "Malformed",
+			lines: []string{"a=candidate:1 1 udp"},
+			want:  []Problem{{Severity: Error, Line: 5}},
+		},
+	} {
+		t.Run(tc.rule+"/"+tc.name, func(t *testing.T) {
+			lines := tc.lines
+			if !tc.raw {
+				lines = append(append([]string(nil), sessionLines...), tc.lines...)
+			}
+			r := ruleByName(t, tc.rule)
+			got := Linter{Rules: []Rule{r}}.Lint(decodeLines(t, lines))
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d problems %v, want %d", len(got), got, len(tc.want))
+			}
+			for i, p := range got {
+				want := tc.want[i]
+				if p.Rule != r.Name || p.Severity != want.Severity || p.Line != want.Line {
+					t.Errorf("got %s at line %d (%s), want %s at line %d",
+						p.Severity, p.Line, p, want.Severity, want.Line,
+					)
+				}
+			}
+		})
+	}
+}
+
+// fingerprint returns digest of n bytes.
+func fingerprint(n int) string {
+	return strings.TrimSuffix(strings.Repeat("AB:", n), ":")
+}
+
+func TestLintValidSession(t *testing.T) {
+	s := decodeLines(t, append(append([]string(nil), sessionLines...),
+		"a=group:BUNDLE 0",
+		"a=ice-ufrag:abcd",
+		"a=ice-pwd:"+strings.Repeat("a", 22),
+		"a=fingerprint:sha-256 "+fingerprint(32),
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111 0",
+		"a=mid:0",
+		"a=rtpmap:111 opus/48000/2",
+		"a=candidate:1 1 udp 2130706431 192.0.2.1 3478 typ host",
+	))
+	if problems := Lint(s); len(problems) > 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// liveKeepAlive is interval of comments that keep idle feed open
+// through proxies.
+const liveKeepAlive = time.Second * 15
+
+// serveLive streams captured STUN messages as Server-Sent Events,
+// optionally filtered by source IP from "ip" query parameter.
+func serveLive(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "streaming is not supported")
+		return
+	}
+	filter := net.ParseIP(r.URL.Query().Get("ip"))
+	events, cancel := messages.subscribe()
+	defer cancel()
+	log.Println("http: live feed for", r.RemoteAddr, "filter", filter)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Disabling response buffering of nginx, so events are not delayed.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(liveKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Println("http: live feed for", r.RemoteAddr, "closed")
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case entry, ok := <-events:
+			if !ok {
+				return
+			}
+			if filter != nil {
+				host, _, err := net.SplitHostPort(entry.Addr)
+				if err != nil || !filter.Equal(net.ParseIP(host)) {
+					continue
+				}
+			}
+			data, err := json.Marshal(newMessageReport(entry))
+			if err != nil {
+				log.Println("http: failed to encode live event:", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: stun\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
@@ -1,13 +1,11 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/csv"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"hash/crc64"
 	"html/template"
 	"io/ioutil"
 	"log"
@@ -15,80 +13,193 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/cloudflare/cloudflare-go"
-	"github.com/gortc/ice"
 	"github.com/gortc/sdp"
 	"github.com/gortc/stun"
-	"github.com/mssola/user_agent"
+	"golang.org/x/net/websocket"
 )
 
+// Secrets are read from environment instead of flags, so they are not
+// exposed in command line:
+//
+//	STUN_USERS   comma-separated user:password short-term credentials
+//	TURN_USERS   comma-separated user:password TURN long-term credentials
+//	TURN_SECRET  shared secret for ephemeral TURN credentials
+//	WHIP_TOKEN   bearer token required by WHIP and WHEP endpoints
 var (
 	portHTTP = flag.Int("port", 3000, "http server port")
 	hostHTTP = flag.String("host", "localhost", "http server host")
+	hostSTUN = flag.String("host-stun", "", "STUN server host")
 	portSTUN = flag.Int("port-stun", stun.DefaultPort, "UDP port")
+	tcpSTUN  = flag.Bool("tcp-stun", true, "also serve STUN over TCP on port-stun")
+
+	portSTUNS = flag.Int("port-stuns", 5349, "STUN over TLS port")
+	tlsCert   = flag.String("tls-cert", "", "TLS certificate file, enables STUN over TLS")
+	tlsKey    = flag.String("tls-key", "", "TLS key file")
+
+	hostSTUNAlt = flag.String("host-stun-alt", "", "alternate STUN server host, enables NAT behavior discovery")
+	portSTUNAlt = flag.Int("port-stun-alt", 3479, "alternate UDP port for NAT behavior discovery")
+
+	ipv6STUN     = flag.Bool("ipv6-stun", true, "also serve STUN over IPv6")
+	hostSTUN6    = flag.String("host-stun6", "", "IPv6 STUN server host")
+	hostSTUNAlt6 = flag.String("host-stun-alt6", "", "alternate IPv6 STUN server host, enables NAT behavior discovery over IPv6")
+
+	publicIPv4 = flag.String("public-ip4", "", "public IPv4 address of STUN server advertised in ice-configuration")
+	publicIPv6 = flag.String("public-ip6", "", "public IPv6 address of STUN server advertised in ice-configuration")
+
+	classicSTUN = flag.Bool("classic-stun", false, "answer RFC 3489 binding requests without magic cookie")
+
+	rateIP     = flag.Int("rate-ip", 20, "STUN packets per second limit for source IP, 0 for no limit")
+	rateSubnet = flag.Int("rate-subnet", 200, "STUN packets per second limit for source subnet, 0 for no limit")
+	rateGlobal = flag.Int("rate-global", 5000, "STUN packets per second limit for all sources, 0 for no limit")
+
+	workersSTUN = flag.Int("workers-stun", runtime.NumCPU(), "number of STUN packet processing workers")
+
+	turnEnabled = flag.Bool("turn", false, "enable TURN server on STUN UDP sockets")
+	turnRealm   = flag.String("turn-realm", "gortc.io", "TURN realm")
+	turnRelayIP = flag.String("turn-relay-ip", "", "public IP of TURN relay addresses")
+	turnMinPort = flag.Int("turn-min-port", 49152, "minimum TURN relay port")
+	turnMaxPort = flag.Int("turn-max-port", 65535, "maximum TURN relay port")
+	turnICEUser = flag.String("turn-ice-user", "", "TURN user with credentials handed out in /ice-configuration")
+	turnTTL     = flag.Duration("turn-ttl", time.Hour*24, "lifetime of ephemeral TURN credentials")
+	turnPeers   = flag.String("turn-allowed-peers", "", "comma-separated CIDR ranges of loopback, private and link-local peers that TURN may relay to")
+
+	storagePath     = flag.String("storage", "", "path to bbolt database of captured STUN messages, in-memory if empty")
+	storageTTL      = flag.Duration("storage-ttl", defaultStorageTTL, "lifetime of captured STUN messages")
+	storageCapacity = flag.Int("storage-capacity", defaultStorageCapacity, "maximum number of captured STUN messages, least recently used are evicted from memory and oldest from bbolt storage")
+
+	mdnsEnabled = flag.Bool("mdns", false, "resolve mDNS candidates in SDP analyzer on local link")
+	mdnsAddr    = flag.String("mdns-addr", mdnsGroup.String(), "address to send mDNS queries to")
+
+	debugAddr = flag.String("debug-addr", "localhost:3001", "address of debug http server with expvar counters, disabled if empty")
 
 	importPath = "gortc.io"
 	repoPath   = "https://github.com/gortc"
 )
 
-var (
-	bindingRequest = stun.MessageType{
-		Method: stun.MethodBinding,
-		Class:  stun.ClassRequest,
+type iceServerConfiguration struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+	// TTL is credentials lifetime in seconds.
+	TTL int `json:"ttl,omitempty"`
+}
+
+type iceConfiguration struct {
+	Servers []iceServerConfiguration `json:"iceServers"`
+}
+
+func tlsEnabled() bool {
+	return len(*tlsCert) > 0 && len(*tlsKey) > 0
+}
+
+// stunURLs returns list of STUN server urls for host.
+func stunURLs(host string) []string {
+	addr := net.JoinHostPort(host, strconv.Itoa(*portSTUN))
+	urls := []string{"stun:" + addr}
+	if *tcpSTUN {
+		urls = append(urls, "stun:"+addr+"?transport=tcp")
 	}
-	bindingSuccessResponse = stun.MessageType{
-		Method: stun.MethodBinding,
-		Class:  stun.ClassSuccessResponse,
+	if tlsEnabled() {
+		urls = append(urls, "stuns:"+net.JoinHostPort(host, strconv.Itoa(*portSTUNS)))
 	}
-)
+	return urls
+}
 
-func processUDPPacket(addr net.Addr, b []byte, req, res *stun.Message) error {
-	if !stun.IsMessage(b) {
-		log.Println("packet from", addr, "is not STUN message")
-		return nil
+// publicIPs returns public addresses of both families that are set and
+// are not equal to host, so browsers can gather server reflexive
+// candidates of every family regardless of how host resolves.
+func publicIPs(host string) []string {
+	var ips []string
+	for _, ip := range []string{*publicIPv4, *publicIPv6} {
+		if len(ip) > 0 && ip != host {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// listenSTUN binds STUN listeners of IP version ("4" or "6") on host
+// and starts serving them. If alt is not empty, NAT behavior discovery
+// is enabled for UDP.
+func listenSTUN(version, host, alt string, certs *certLoader, turn *turnServer) error {
+	var (
+		addr    = net.JoinHostPort(host, strconv.Itoa(*portSTUN))
+		primary = &net.UDPAddr{IP: net.ParseIP(host), Port: *portSTUN}
+		altAddr *net.UDPAddr
+	)
+	if len(alt) > 0 {
+		if primary.IP == nil {
+			return errors.New("explicit host is required for NAT behavior discovery")
+		}
+		altAddr = &net.UDPAddr{IP: net.ParseIP(alt), Port: *portSTUNAlt}
+		if altAddr.IP == nil {
+			return fmt.Errorf("bad alternate host %q", alt)
+		}
 	}
-	req.Raw = b
-	if err := req.Decode(); err != nil {
+	udpServer, err := listenUDP("udp"+version, primary, altAddr)
+	if err != nil {
 		return err
 	}
-	if req.Type != bindingRequest {
-		log.Println("stun: skipping", req.Type, "from", addr)
-		return nil
+	listeners := []net.Listener{}
+	closeAll := func() {
+		udpServer.Close()
+		for _, l := range listeners {
+			l.Close()
+		}
 	}
-	log.Println("stun: got", req.Type)
-	res.TransactionID = req.TransactionID
-	res.Type = bindingSuccessResponse
-	var (
-		ip   net.IP
-		port int
-	)
-	switch a := addr.(type) {
-	case *net.UDPAddr:
-		ip = a.IP
-		port = a.Port
-	default:
-		panic(fmt.Sprintf("unknown addr: %v", addr))
+	if *tcpSTUN {
+		log.Println("Listening tcp"+version, addr)
+		l, err := net.Listen("tcp"+version, addr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	if certs != nil {
+		addrSTUNS := net.JoinHostPort(host, strconv.Itoa(*portSTUNS))
+		log.Println("Listening tls"+version, addrSTUNS)
+		l, err := tls.Listen("tcp"+version, addrSTUNS, &tls.Config{
+			GetCertificate: certs.GetCertificate,
+		})
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	udpServer.turn = turn
+	for _, l := range listeners {
+		go serveTCP(l)
 	}
-	stun.XORMappedAddress{
-		IP:   ip,
-		Port: port,
-	}.AddTo(res)
-	stun.NewSoftware("gortc.io/x/sdp example").AddTo(res)
-	res.WriteHeader()
-	messages.add(fmt.Sprintf("%s:%d", ip, port), req)
+	udpServer.serve(*workersSTUN)
 	return nil
 }
 
-type iceServerConfiguration struct {
-	URLs []string `json:"urls"`
-}
-
-type iceConfiguration struct {
-	Servers []iceServerConfiguration `json:"iceServers"`
+// turnICEServer returns configuration of TURN server on hosts with
+// credentials for client, false if there are no credentials to hand
+// out.
+func turnICEServer(turn *turnServer, hosts []string) (iceServerConfiguration, bool) {
+	c := iceServerConfiguration{}
+	for _, h := range hosts {
+		c.URLs = append(c.URLs,
+			"turn:"+net.JoinHostPort(h, strconv.Itoa(*portSTUN))+"?transport=udp",
+		)
+	}
+	if turn.secret != nil {
+		c.Username, c.Credential = turn.ephemeralCredentials(newUserID(), *turnTTL)
+		c.TTL = int(*turnTTL / time.Second)
+	} else if password, ok := turn.password(*turnICEUser); ok {
+		c.Username, c.Credential = *turnICEUser, password
+	}
+	return c, len(c.Username) > 0
 }
 
 func redirectToDocs(path string) bool {
@@ -115,6 +226,9 @@ func main() {
 	}
 	log.SetFlags(log.Lshortfile)
 	fs := http.FileServer(http.Dir("static"))
+	// Public handlers have own mux, because http.DefaultServeMux has
+	// /debug/vars of expvar that exposes command line.
+	mux := http.NewServeMux()
 	var (
 		s     *stats
 		sLock sync.RWMutex
@@ -148,7 +262,7 @@ func main() {
 			_ = update()
 		}
 	}()
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
 		if q.Get("go-get") == "1" || redirectToDocs(r.URL.Path) {
 			r.Host = "gortc.io"
@@ -169,7 +283,7 @@ func main() {
 		}
 		sLock.RUnlock()
 	})
-	http.HandleFunc("/hook/"+os.Getenv("GITHUB_HOOK_SECRET"), func(writer http.ResponseWriter, request *http.Request) {
+	mux.HandleFunc("/hook/"+os.Getenv("GITHUB_HOOK_SECRET"), func(writer http.ResponseWriter, request *http.Request) {
 		start := time.Now()
 		err := update()
 		if err != nil {
@@ -202,28 +316,65 @@ func main() {
 			}
 		}()
 	})
-	http.HandleFunc("/ice-configuration", func(w http.ResponseWriter, r *http.Request) {
+	var turn *turnServer
+	if *turnEnabled {
+		relayIP := net.ParseIP(*turnRelayIP)
+		if relayIP == nil {
+			log.Fatalf("Bad turn-relay-ip %q", *turnRelayIP)
+		}
+		users, err := parseCredentials(os.Getenv("TURN_USERS"))
+		if err != nil {
+			log.Fatalln("Failed to parse TURN_USERS:", err)
+		}
+		turn, err = newTURNServer(*turnRealm, relayIP, *turnMinPort, *turnMaxPort, users)
+		if err != nil {
+			log.Fatalln("Failed to create TURN server:", err)
+		}
+		if turn.allowedPeers, err = parseCIDRs(*turnPeers); err != nil {
+			log.Fatalln("Failed to parse turn-allowed-peers:", err)
+		}
+		// Shared secret for ephemeral credentials, disabled if empty.
+		if secret := os.Getenv("TURN_SECRET"); len(secret) > 0 {
+			turn.secret = []byte(secret)
+		}
+	}
+	mux.HandleFunc("/ice-configuration", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-type", "application/json")
 		encoder := json.NewEncoder(w)
 		origin := r.Header.Get("Origin")
-		server := "stun:gortc.io"
+		var (
+			host    = "gortc.io"
+			servers = []string{"stun:gortc.io"}
+		)
 		if len(origin) > 0 {
 			u, err := url.Parse(origin)
 			if err != nil {
 				log.Printf("http: failed to parse origin %q: %s", origin, err)
+			} else if len(u.Hostname()) == 0 {
+				log.Printf("http: no host in origin %q", origin)
 			} else {
-				if idx := strings.LastIndex(u.Host, ":"); idx > 0 {
-					u.Host = u.Host[:idx]
-				}
-				server = fmt.Sprintf("stun:%s:%d", u.Host, *portSTUN)
-				log.Printf("http: sending ice-server %q for origin %q", server, origin)
+				// Hostname strips port and brackets of IPv6 literal.
+				host = u.Hostname()
+				servers = stunURLs(host)
 			}
 		}
-		if err := encoder.Encode(iceConfiguration{
+		for _, ip := range publicIPs(host) {
+			servers = append(servers, stunURLs(ip)...)
+		}
+		if len(origin) > 0 {
+			log.Printf("http: sending ice-servers %q for origin %q", servers, origin)
+		}
+		config := iceConfiguration{
 			Servers: []iceServerConfiguration{
-				{URLs: []string{server}},
+				{URLs: servers},
 			},
-		}); err != nil {
+		}
+		if turn != nil {
+			if turnServer, ok := turnICEServer(turn, append([]string{host}, publicIPs(host)...)); ok {
+				config.Servers = append(config.Servers, turnServer)
+			}
+		}
+		if err := encoder.Encode(config); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintln(w, "json encode:", err)
 		}
@@ -234,15 +385,22 @@ func main() {
 		log.Fatalln("Failed to open log:", err)
 	}
 	defer mLog.Close()
-	csvLog := csv.NewWriter(mLog)
+	packets = newPacketLog(mLog, *storageTTL)
+	go packets.gc()
 
-	http.HandleFunc("/x/sdp", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/x/sdp", func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		log.Println("http:", r.Method, "request from", r.RemoteAddr)
 		if r.Method == http.MethodGet {
 			http.Redirect(w, r, "/x/sdp/", http.StatusPermanentRedirect)
 			return
 		}
+		// Candidates are sent with session ID of offer.
+		sessionID := r.URL.Query().Get("session")
+		if sessionID != "" && !trickle.exists(sessionID) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		s := sdp.Session{}
 		data, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -252,115 +410,192 @@ func main() {
 		}
 		if s, err = sdp.DecodeSession(data, s); err != nil {
 			log.Println("http: failed to decode sdp session:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		for k, v := range s {
-			fmt.Fprintf(w, `<p class="attribute">%02d %s</p>`+"\n", k, v)
-			if v.Type != sdp.TypeAttribute {
-				continue
-			}
-			if !bytes.HasPrefix(v.Value, []byte("candidate")) {
-				continue
-			}
-			c := new(ice.Candidate)
-			fmt.Fprintln(w, `<div class="stun-message">`)
-			if err = ice.ParseAttribute(v.Value, c); err != nil {
-				fmt.Fprintln(w, `<p class="error">failed to parse as candidate:`, err, "</p>")
-				fmt.Fprintln(w, `</div>`)
-				continue
-			}
-			fmt.Fprintln(w, "<p>parsed as candidate:", fmt.Sprintf("%+v", c), "</p>")
-			if c.Type != ice.CandidateServerReflexive {
-				fmt.Fprintln(w, `</div>`)
-				continue
-			}
-			addr := fmt.Sprintf("%s:%d", c.ConnectionAddress, c.Port)
-			m := messages.pop(addr)
-			if m == nil {
-				log.Println("http: no message for", addr, "in log")
-				fmt.Fprintln(w, `<p class="warning">message from candidate not found in STUN log</p>`)
-				fmt.Fprintln(w, `</div>`)
-				continue
-			}
-			fmt.Fprintln(w, `<p class="success">message found in STUN log:`, m, `</p>`)
-			for _, a := range m.Attributes {
-				switch a.Type {
-				case stun.AttrOrigin:
-					fmt.Fprintf(w, "<p>STUN attribute %s: %q (len=%d)</p>", a.Type, a.Value, a.Length)
-				default:
-					fmt.Fprintf(w, "<p>STUN attribute %s: %v (len=%d)</p>", a.Type, a.Value, a.Length)
-				}
+		report := reportSDP(s, string(data), sessionID, r.Header.Get("User-agent"))
+		if report.SessionID != "" {
+			w.Header().Set("X-Session-ID", report.SessionID)
+		}
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			if err = json.NewEncoder(w).Encode(report); err != nil {
+				log.Println("http: failed to encode report:", err)
 			}
-			var (
-				b64             = base64.StdEncoding.EncodeToString(m.Raw)
-				messageCRC64    = crc64.Checksum(m.Raw, crc64.MakeTable(crc64.ISO))
-				clipID          = fmt.Sprintf("crc64-%d", messageCRC64)
-				ua              = user_agent.New(r.Header.Get("User-agent"))
-				bName, bVersion = ua.Browser()
-			)
-			if err = csvLog.Write([]string{
-				addr,
-				b64,
-				fmt.Sprintf("%d", messageCRC64),
-				bName,
-				bVersion,
-				ua.OS(),
-			}); err != nil {
-				log.Fatalln("log: failed to write:", err)
+			return
+		}
+		if err = report.writeHTML(w); err != nil {
+			log.Println("http: failed to render report:", err)
+		}
+	})
+
+	mux.HandleFunc("/x/sdp/session/", func(w http.ResponseWriter, r *http.Request) {
+		session := trickle.timeline(strings.TrimPrefix(r.URL.Path, "/x/sdp/session/"), messages)
+		if session == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(session); err != nil {
+				log.Println("http: failed to encode session:", err)
 			}
-			csvLog.Flush()
-			fmt.Fprintln(w, `<p>dumped: <code id="`+clipID+`">stun-decode`, b64, `</code>
-				<button class="btn" data-clipboard-target="#`+clipID+`">copy</button>
-			</p>`)
-			fmt.Fprintln(w, `<p>crc64: <code>`, messageCRC64, `</code></p>`)
-			fmt.Fprintln(w, `</div>`)
+			return
+		}
+		if err := session.writeHTML(w); err != nil {
+			log.Println("http: failed to render session:", err)
 		}
 	})
+	mux.HandleFunc("/x/live", serveLive)
+	mux.Handle("/x/sdp/ws", websocket.Handler(serveSignaling))
 
-	var (
-		addrSTUN = fmt.Sprintf(":%d", *portSTUN)
-		addrHTTP = fmt.Sprintf("%s:%d", *hostHTTP, *portHTTP)
-	)
-	log.Println("Listening udp", addrSTUN)
-	c, err := net.ListenPacket("udp", addrSTUN)
-	if err != nil {
-		log.Fatalf("Failed to bind udp on %s: %s", addrSTUN, err)
+	if *mdnsEnabled {
+		addr, err := net.ResolveUDPAddr("udp4", *mdnsAddr)
+		if err != nil {
+			log.Fatalln("Failed to resolve mDNS address:", err)
+		}
+		mdns = newMDNSResolver(addr, mdnsTimeout)
+		log.Println("Resolving mDNS candidates via", addr)
 	}
-	defer c.Close()
 
-	// spawning storage garbage collector
-	go messages.gc()
+	if lite, err = newICELite(); err != nil {
+		log.Fatalln("Failed to create ICE-lite agent:", err)
+	}
+	mux.HandleFunc("/x/sdp/answer", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ips, err := candidateIPs()
+		if err != nil {
+			log.Println("http: failed to answer offer:", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("http: ReadAll body failed:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		offer, err := sdp.DecodeSession(data, nil)
+		if err != nil {
+			log.Println("http: failed to decode offer:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		session, answer, err := lite.answer(offer, ips, "", "")
+		switch err {
+		case nil:
+		case errTooManySessions:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		default:
+			log.Println("http: failed to answer offer:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "failed to answer:", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", "/x/sdp/ice/"+session.LocalUfrag)
+		w.Header().Set("Warning", iceLiteWarning)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(encodeSDP(answer))
+	})
+	mux.HandleFunc("/x/sdp/ice/", func(w http.ResponseWriter, r *http.Request) {
+		// Sessions of WHIP and WHEP are not exposed, because page is
+		// not authenticated.
+		session := lite.snapshot("", strings.TrimPrefix(r.URL.Path, "/x/sdp/ice/"))
+		if session == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Add("Content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(session); err != nil {
+			log.Println("http: failed to encode session:", err)
+		}
+	})
+	// Bearer token is not required if empty.
+	whipToken := os.Getenv("WHIP_TOKEN")
+	for _, e := range []whipEndpoint{
+		{path: "/whip", direction: "recvonly", token: whipToken},
+		{path: "/whep", direction: "sendonly", token: whipToken},
+	} {
+		mux.Handle(e.path, e)
+		mux.Handle(e.path+"/", e)
+	}
 
-	// spawning STUN server
-	go func(conn net.PacketConn) {
-		log.Println("Started STUN server on", conn.LocalAddr())
-		var (
-			res = new(stun.Message)
-			req = new(stun.Message)
-			buf = make([]byte, 1024)
-		)
-		for {
-			// ReadFrom c to buf
-			n, addr, err := c.ReadFrom(buf)
-			if err != nil {
-				log.Fatalln("c.ReadFrom:", err)
-			}
-			log.Printf("udp: got packet len(%d) from %s", n, addr)
-			// processing binding request
-			if err = processUDPPacket(addr, buf[:n], req, res); err != nil {
-				log.Println("failed to process UDP packet:", err, "from addr", addr)
-			} else {
-				log.Printf("stun: parsed message %q from %s", req, addr)
-				if _, err = c.WriteTo(res.Raw, addr); err != nil {
-					log.Println("failed to send packet:", err)
-				}
+	passwords, err := parseCredentials(os.Getenv("STUN_USERS"))
+	if err != nil {
+		log.Fatalln("Failed to parse STUN_USERS:", err)
+	}
+	for username, password := range passwords {
+		credentials.set(username, password)
+	}
+	limiter = newRateLimiter(*rateIP, *rateSubnet, *rateGlobal)
+	go limiter.gc()
+	if ip := net.ParseIP(*publicIPv4); len(*publicIPv4) > 0 && (ip == nil || ip.To4() == nil) {
+		log.Fatalf("Bad public-ip4 %q", *publicIPv4)
+	}
+	if ip := net.ParseIP(*publicIPv6); len(*publicIPv6) > 0 && (ip == nil || ip.To4() != nil) {
+		log.Fatalf("Bad public-ip6 %q", *publicIPv6)
+	}
+	var certs *certLoader
+	if tlsEnabled() {
+		certs, err = newCertLoader(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalln("Failed to load certificate:", err)
+		}
+		go certs.watch(time.Minute)
+	}
+	// Storage is set before any listener starts, because STUN servers
+	// add messages to it concurrently.
+	if len(*storagePath) > 0 {
+		db, err := newBoltStorage(*storagePath, *storageTTL, *storageCapacity)
+		if err != nil {
+			log.Fatalln("Failed to open storage:", err)
+		}
+		defer db.Close()
+		messages = db
+	} else {
+		messages = newMemoryStorage(*storageTTL, *storageCapacity)
+	}
+	if turn != nil {
+		go turn.gc()
+	}
+	// Every address family has own sockets, so IPv6 clients are
+	// not served via IPv4-mapped addresses.
+	if err = listenSTUN("4", *hostSTUN, *hostSTUNAlt, certs, turn); err != nil {
+		log.Fatalln("Failed to serve STUN over IPv4:", err)
+	}
+	if *ipv6STUN {
+		if err = listenSTUN("6", *hostSTUN6, *hostSTUNAlt6, certs, turn); err != nil {
+			if len(*hostSTUN6) > 0 {
+				log.Fatalln("Failed to serve STUN over IPv6:", err)
 			}
-			res.Reset()
-			req.Reset()
+			// Host may have no IPv6 support at all.
+			log.Println("Not serving STUN over IPv6:", err)
 		}
+	}
+	// spawning storage garbage collector
+	go collectStorage(messages, storageGCInterval)
+	go lite.gc()
+	go trickle.gc()
 
-	}(c)
+	if len(*debugAddr) > 0 {
+		log.Println("Listening debug http", *debugAddr)
+		go func() {
+			log.Fatal(http.ListenAndServe(*debugAddr, nil))
+		}()
+	}
+	addrHTTP := fmt.Sprintf("%s:%d", *hostHTTP, *portHTTP)
 	log.Println("Listening http", addrHTTP)
-	log.Fatal(http.ListenAndServe(addrHTTP, nil))
+	log.Fatal(http.ListenAndServe(addrHTTP, mux))
 }
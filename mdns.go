@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gortc/ice"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// mdnsTimeout is how long resolver waits for responses.
+	mdnsTimeout = time.Second
+	// mdnsMaxTTL limits caching of resolved names.
+	mdnsMaxTTL = time.Minute
+	// mdnsNegativeTTL is how long names that were not resolved are
+	// cached, so repeated offers don't wait for timeout again.
+	mdnsNegativeTTL = time.Second * 10
+	// mdnsMaxCached limits number of cached names.
+	mdnsMaxCached = 1000
+	// mdnsMaxNames limits number of names resolved for single SDP.
+	mdnsMaxNames = 8
+)
+
+var (
+	// mdnsGroup is IPv4 multicast DNS group, RFC 6762 Section 3.
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+	mdnsStats = expvar.NewMap("mdns")
+
+	errMDNSNotFound = errors.New("mdns: name not resolved")
+	errMDNSTooMany  = errors.New("mdns: too many names to resolve")
+)
+
+// isMDNSName reports whether host is multicast DNS name, like random
+// "<uuid>.local" names that browsers use to hide host candidates.
+func isMDNSName(host string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(strings.ToLower(host), "."), ".local")
+}
+
+// mdnsEntry is cached result of resolution, err is errMDNSNotFound if
+// name was not resolved.
+type mdnsEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// mdnsResolver resolves .local names with one-shot multicast DNS
+// queries, RFC 6762 Section 5.1, so responses are sent directly to
+// ephemeral port of resolver.
+type mdnsResolver struct {
+	// addr is multicast group or address of responder.
+	addr    *net.UDPAddr
+	timeout time.Duration
+
+	mux   sync.Mutex
+	cache map[string]mdnsEntry
+}
+
+// newMDNSResolver returns resolver that sends queries to addr.
+func newMDNSResolver(addr *net.UDPAddr, timeout time.Duration) *mdnsResolver {
+	return &mdnsResolver{
+		addr:    addr,
+		timeout: timeout,
+		cache:   make(map[string]mdnsEntry),
+	}
+}
+
+// mdns resolves mDNS candidates in /x/sdp analyzer if not nil.
+var mdns *mdnsResolver
+
+func mdnsQuery(name dnsmessage.Name) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		if err := b.Question(dnsmessage.Question{
+			Name:  name,
+			Type:  t,
+			Class: dnsmessage.ClassINET,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// parseMDNSResponse returns addresses of name from response and minimal
+// TTL of them.
+func parseMDNSResponse(b []byte, name string) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !h.Response {
+		return nil, 0, nil
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	var (
+		ips []net.IP
+		ttl = mdnsMaxTTL
+	)
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if !strings.EqualFold(rh.Name.String(), name) {
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		default:
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if d := time.Duration(rh.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ips, ttl, nil
+}
+
+// resolve returns addresses of mDNS host name.
+func (r *mdnsResolver) resolve(host string) ([]net.IP, error) {
+	name := strings.ToLower(host)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	r.mux.Lock()
+	entry, ok := r.cache[name]
+	r.mux.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		mdnsStats.Add("cached", 1)
+		return entry.ips, entry.err
+	}
+	dnsName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	query, err := mdnsQuery(dnsName)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if _, err = c.WriteTo(query, r.addr); err != nil {
+		return nil, err
+	}
+	if err = c.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				mdnsStats.Add("timeout", 1)
+				r.store(name, mdnsEntry{err: errMDNSNotFound, expires: time.Now().Add(mdnsNegativeTTL)})
+				return nil, errMDNSNotFound
+			}
+			return nil, err
+		}
+		ips, ttl, err := parseMDNSResponse(buf[:n], name)
+		if err != nil {
+			log.Println("mdns: failed to parse response from", addr, err)
+			continue
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		mdnsStats.Add("resolved", 1)
+		r.store(name, mdnsEntry{ips: ips, expires: time.Now().Add(ttl)})
+		return ips, nil
+	}
+}
+
+func (r *mdnsResolver) store(name string, entry mdnsEntry) {
+	r.mux.Lock()
+	if len(r.cache) >= mdnsMaxCached {
+		r.cache = make(map[string]mdnsEntry)
+	}
+	r.cache[name] = entry
+	r.mux.Unlock()
+}
+
+// mdnsCandidate is candidate with mDNS address and its report.
+type mdnsCandidate struct {
+	candidate *ice.Candidate
+	report    *candidateReport
+}
+
+// resolveCandidates concurrently resolves mDNS addresses of candidates,
+// updating reports and replacing addresses of candidates with first
+// resolved ones. Only first mdnsMaxNames distinct names are resolved.
+func resolveCandidates(r *mdnsResolver, candidates []mdnsCandidate) {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	var (
+		names   = make(map[string]*result)
+		wg      sync.WaitGroup
+		results []*result
+	)
+	for _, c := range candidates {
+		name := strings.ToLower(string(c.candidate.ConnectionAddress.Host))
+		res, ok := names[name]
+		if !ok {
+			res = &result{err: errMDNSTooMany}
+			names[name] = res
+			if len(names) <= mdnsMaxNames {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					res.ips, res.err = r.resolve(name)
+				}()
+			} else {
+				mdnsStats.Add("too_many", 1)
+			}
+		}
+		results = append(results, res)
+	}
+	wg.Wait()
+	for i, c := range candidates {
+		res := results[i]
+		if res.err != nil {
+			c.report.ResolveError = res.err.Error()
+			continue
+		}
+		for _, ip := range res.ips {
+			c.report.Resolved = append(c.report.Resolved, ip.String())
+		}
+		c.candidate.ConnectionAddress = ice.ConnectionAddress{IP: res.ips[0], Type: ice.AddressIPv6}
+		if res.ips[0].To4() != nil {
+			c.candidate.ConnectionAddress.Type = ice.AddressIPv4
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gortc/ice"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsResponder answers A questions for names on loopback, counting
+// received questions by name.
+type mdnsResponder struct {
+	conn  *net.UDPConn
+	names map[string]net.IP
+
+	mux       sync.Mutex
+	questions map[string]int
+}
+
+func newMDNSResponder(t *testing.T, names map[string]net.IP) *mdnsResponder {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &mdnsResponder{
+		conn:      conn,
+		names:     names,
+		questions: make(map[string]int),
+	}
+	t.Cleanup(func() { conn.Close() })
+	go r.serve(t)
+	return r
+}
+
+func (r *mdnsResponder) count(name string) int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.questions[name]
+}
+
+func (r *mdnsResponder) serve(t *testing.T) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		if _, err = p.Start(buf[:n]); err != nil {
+			t.Error(err)
+			return
+		}
+		questions, err := p.AllQuestions()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+		if err = b.StartAnswers(); err != nil {
+			t.Error(err)
+			return
+		}
+		answered := false
+		for _, q := range questions {
+			name := q.Name.String()
+			if q.Type == dnsmessage.TypeA {
+				r.mux.Lock()
+				r.questions[name]++
+				r.mux.Unlock()
+			}
+			ip, ok := r.names[name]
+			if !ok || q.Type != dnsmessage.TypeA {
+				continue
+			}
+			answered = true
+			var a dnsmessage.AResource
+			copy(a.A[:], ip.To4())
+			if err = b.AResource(dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Class: dnsmessage.ClassINET,
+				TTL:   120,
+			}, a); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if !answered {
+			// Responders stay silent for unknown names.
+			continue
+		}
+		res, err := b.Finish()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err = r.conn.WriteTo(res, addr); err != nil {
+			return
+		}
+	}
+}
+
+func TestMDNSResolver(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	responder := newMDNSResponder(t, map[string]net.IP{
+		"known.local.": net.IPv4(192, 168, 1, 10),
+	})
+	r := newMDNSResolver(responder.conn.LocalAddr().(*net.UDPAddr), time.Millisecond*200)
+	for i := 0; i < 2; i++ {
+		ips, err := r.resolve("Known.local")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 168, 1, 10)) {
+			t.Errorf("bad addresses %v", ips)
+		}
+		if _, err = r.resolve("unknown.local"); err != errMDNSNotFound {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	// Both positive and negative results are cached.
+	for _, name := range []string{"known.local.", "unknown.local."} {
+		if n := responder.count(name); n != 1 {
+			t.Errorf("%s queried %d times", name, n)
+		}
+	}
+}
+
+func TestResolveCandidates(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	names := make(map[string]net.IP)
+	for i := 0; i < mdnsMaxNames/2; i++ {
+		names[fmt.Sprintf("known-%d.local.", i)] = net.IPv4(192, 168, 1, byte(i))
+	}
+	var (
+		responder  = newMDNSResponder(t, names)
+		timeout    = time.Millisecond * 200
+		r          = newMDNSResolver(responder.conn.LocalAddr().(*net.UDPAddr), timeout)
+		candidates []mdnsCandidate
+	)
+	add := func(name string) {
+		candidates = append(candidates, mdnsCandidate{
+			candidate: &ice.Candidate{
+				ConnectionAddress: ice.ConnectionAddress{Host: []byte(name), Type: ice.AddressFQDN},
+			},
+			report: &candidateReport{MDNS: true},
+		})
+	}
+	for i := 0; i < mdnsMaxNames/2; i++ {
+		add(fmt.Sprintf("known-%d.local", i))
+		// Second component has same name.
+		add(fmt.Sprintf("KNOWN-%d.local", i))
+	}
+	for i := 0; i < mdnsMaxNames; i++ {
+		add(fmt.Sprintf("unknown-%d.local", i))
+	}
+	start := time.Now()
+	resolveCandidates(r, candidates)
+	// Names are resolved concurrently, waiting for timeout once.
+	if d := time.Since(start); d > timeout*3 {
+		t.Errorf("resolved in %s", d)
+	}
+	for i, c := range candidates {
+		name := strings.ToLower(string(c.candidate.ConnectionAddress.Host)) + "."
+		switch {
+		case i < mdnsMaxNames:
+			if c.report.ResolveError != "" || len(c.report.Resolved) != 1 {
+				t.Errorf("candidate %d is not resolved: %+v", i, c.report)
+			}
+			if !c.candidate.ConnectionAddress.IP.Equal(names[fmt.Sprintf("known-%d.local.", i/2)]) {
+				t.Errorf("candidate %d address is not replaced: %s", i, c.candidate.ConnectionAddress)
+			}
+			if c.candidate.ConnectionAddress.Type != ice.AddressIPv4 {
+				t.Errorf("candidate %d address type is %s", i, c.candidate.ConnectionAddress.Type)
+			}
+		case i < mdnsMaxNames+mdnsMaxNames/2:
+			if c.report.ResolveError != errMDNSNotFound.Error() {
+				t.Errorf("candidate %d error is %q", i, c.report.ResolveError)
+			}
+			if n := responder.count(name); n != 1 {
+				t.Errorf("%s queried %d times", name, n)
+			}
+		default:
+			// Exceeding mdnsMaxNames.
+			if c.report.ResolveError != errMDNSTooMany.Error() {
+				t.Errorf("candidate %d error is %q", i, c.report.ResolveError)
+			}
+			if n := responder.count(name); n != 0 {
+				t.Errorf("%s queried %d times", name, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mssola/user_agent"
+)
+
+// packetLogKey identifies logged STUN message.
+type packetLogKey struct {
+	addr  string
+	crc64 uint64
+}
+
+// packetLog writes STUN messages of reported candidates as CSV rows of
+// address, message, its CRC64 and browser of client.
+//
+// Messages are reported again on every lookup while stored, so each
+// one is written once and remembered until it is expired from storage.
+type packetLog struct {
+	mux sync.Mutex
+	w   *csv.Writer
+	ttl time.Duration
+	// logged are capture times of written messages.
+	logged map[packetLogKey]time.Time
+}
+
+// packets is log of reported STUN messages, packets.log by default.
+var packets = newPacketLog(ioutil.Discard, defaultStorageTTL)
+
+// newPacketLog returns log that writes to w and remembers written
+// messages captured less than ttl ago.
+func newPacketLog(w io.Writer, ttl time.Duration) *packetLog {
+	return &packetLog{
+		w:      csv.NewWriter(w),
+		ttl:    ttl,
+		logged: make(map[packetLogKey]time.Time),
+	}
+}
+
+// write writes messages of report that were not written yet, with
+// browser from userAgent header.
+func (l *packetLog) write(report sdpReport, userAgent string) error {
+	var (
+		ua              = user_agent.New(userAgent)
+		bName, bVersion = ua.Browser()
+	)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, line := range report.Lines {
+		if line.Candidate == nil {
+			continue
+		}
+		for _, m := range line.Candidate.Messages {
+			k := packetLogKey{addr: m.Addr, crc64: m.CRC64}
+			if _, ok := l.logged[k]; ok {
+				continue
+			}
+			if err := l.w.Write([]string{
+				m.Addr,
+				m.Base64,
+				strconv.FormatUint(m.CRC64, 10),
+				bName,
+				bVersion,
+				ua.OS(),
+			}); err != nil {
+				return err
+			}
+			l.logged[k] = m.Time
+		}
+	}
+	l.w.Flush()
+	return l.w.Error()
+}
+
+// collect forgets messages that are expired from storage.
+func (l *packetLog) collect() {
+	timeout := time.Now().Add(-l.ttl)
+	l.mux.Lock()
+	for k, t := range l.logged {
+		if t.Before(timeout) {
+			delete(l.logged, k)
+		}
+	}
+	l.mux.Unlock()
+}
+
+func (l *packetLog) gc() {
+	ticker := time.NewTicker(time.Second * 5)
+	for range ticker.C {
+		l.collect()
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestPacketLog(t *testing.T) {
+	var (
+		buf = new(bytes.Buffer)
+		l   = newPacketLog(buf, time.Minute)
+		now = time.Now()
+	)
+	candidate := &candidateReport{
+		Reflexive: true,
+		Messages: []messageReport{
+			{Addr: "192.0.2.1:3478", Base64: "AA==", CRC64: 1, Time: now},
+			{Addr: "192.0.2.1:3478", Base64: "AQ==", CRC64: 2, Time: now.Add(-time.Hour)},
+		},
+	}
+	report := sdpReport{Lines: []lineReport{
+		{Key: "a", Value: "candidate"},
+		{Key: "a", Value: "candidate", Candidate: candidate},
+	}}
+	rows := func() int {
+		t.Helper()
+		records, err := csv.NewReader(bytes.NewReader(buf.Bytes())).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(records)
+	}
+	for _, ua := range []string{"", "Mozilla/5.0"} {
+		if err := l.write(report, ua); err != nil {
+			t.Fatal(err)
+		}
+		if n := rows(); n != 2 {
+			t.Fatalf("rows: %d, expected 2", n)
+		}
+	}
+	// Same message from other address is logged.
+	candidate.Messages = append(candidate.Messages, messageReport{
+		Addr: "192.0.2.2:3478", Base64: "AA==", CRC64: 1, Time: now,
+	})
+	if err := l.write(report, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := rows(); n != 3 {
+		t.Fatalf("rows: %d, expected 3", n)
+	}
+	l.collect()
+	if len(l.logged) != 2 {
+		t.Errorf("logged: %d, expected 2 after collect", len(l.logged))
+	}
+}
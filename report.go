@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"hash/crc64"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gortc/ice"
+	"github.com/gortc/sdp"
+	"github.com/gortc/stun"
+
+	"github.com/gortc/web/lint"
+)
+
+var crc64Table = crc64.MakeTable(crc64.ISO)
+
+// attributeReport is STUN attribute of messageReport.
+type attributeReport struct {
+	Type   string `json:"type"`
+	Length int    `json:"length"`
+	Value  string `json:"value"` // hex encoded
+	// Text is value of textual attributes like ORIGIN or SOFTWARE.
+	Text string `json:"text,omitempty"`
+}
+
+// messageReport is captured STUN message.
+type messageReport struct {
+	Addr          string            `json:"addr"`
+	TransactionID string            `json:"transaction_id"` // hex encoded
+	Type          string            `json:"type"`
+	Attributes    []attributeReport `json:"attributes"`
+	Time          time.Time         `json:"time"`
+
+	// Summary is string representation of message.
+	Summary string `json:"summary,omitempty"`
+	// Base64 is raw message as accepted by stun-decode.
+	Base64 string `json:"base64,omitempty"`
+	CRC64  uint64 `json:"crc64,omitempty"`
+	// SincePrevious is time since previous message from address.
+	SincePrevious time.Duration `json:"since_previous_ns,omitempty"`
+}
+
+func isTextAttribute(t stun.AttrType) bool {
+	switch t {
+	case stun.AttrOrigin, stun.AttrSoftware, stun.AttrUsername, stun.AttrRealm:
+		return true
+	default:
+		return false
+	}
+}
+
+func newMessageReport(entry storedMessage) messageReport {
+	m := entry.Message
+	r := messageReport{
+		Addr:          entry.Addr,
+		TransactionID: hex.EncodeToString(m.TransactionID[:]),
+		Type:          m.Type.String(),
+		Attributes:    make([]attributeReport, 0, len(m.Attributes)),
+		Time:          entry.CreatedAt,
+	}
+	for _, a := range m.Attributes {
+		attr := attributeReport{
+			Type:   a.Type.String(),
+			Length: int(a.Length),
+			Value:  hex.EncodeToString(a.Value),
+		}
+		if isTextAttribute(a.Type) {
+			attr.Text = string(a.Value)
+		}
+		r.Attributes = append(r.Attributes, attr)
+	}
+	return r
+}
+
+// candidateReport is ICE candidate parsed from SDP attribute.
+type candidateReport struct {
+	Error string `json:"error,omitempty"`
+
+	Foundation     int    `json:"foundation"`
+	ComponentID    int    `json:"component"`
+	Priority       int    `json:"priority"`
+	Address        string `json:"address"`
+	Port           int    `json:"port"`
+	Transport      string `json:"transport"`
+	Type           string `json:"type"`
+	RelatedAddress string `json:"related_address,omitempty"`
+	RelatedPort    int    `json:"related_port,omitempty"`
+	NetworkCost    int    `json:"network_cost,omitempty"`
+	Generation     int    `json:"generation,omitempty"`
+	// MDNS is true for host candidates obfuscated with random mDNS name.
+	MDNS bool `json:"mdns,omitempty"`
+	// Resolved are addresses of mDNS name if resolver is enabled.
+	Resolved     []string `json:"resolved,omitempty"`
+	ResolveError string   `json:"resolve_error,omitempty"`
+	// PriorityBreakdown is priority recomputed from its components.
+	PriorityBreakdown *priorityReport `json:"priority_breakdown,omitempty"`
+
+	// Reflexive is true for server reflexive candidates, which are
+	// matched with captured binding requests in Messages.
+	Reflexive bool            `json:"reflexive"`
+	Messages  []messageReport `json:"messages,omitempty"`
+}
+
+// lineReport is single decoded SDP line.
+type lineReport struct {
+	Index     int              `json:"index"`
+	Key       string           `json:"key"`
+	Type      string           `json:"type"`
+	Value     string           `json:"value"`
+	Candidate *candidateReport `json:"candidate,omitempty"`
+}
+
+// sdpReport is result of /x/sdp analysis, view model that is rendered
+// as HTML or JSON.
+type sdpReport struct {
+	Lines []lineReport `json:"lines"`
+	// Session is media-level breakdown, nil if body is not complete
+	// session description, e.g. single trickled candidate.
+	Session *sessionReport `json:"session,omitempty"`
+	// SessionError is error of decoding as sdp.Message.
+	SessionError string `json:"session_error,omitempty"`
+	// Candidates groups candidates by foundation and simulates pairing,
+	// nil if there are no valid candidates.
+	Candidates *candidatesReport `json:"candidates,omitempty"`
+	// Problems are found by lint.DefaultRules.
+	Problems []lint.Problem `json:"problems,omitempty"`
+	// SessionID is trickle session that report was recorded to.
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// isOffer reports whether report is of complete session description,
+// which starts trickle session, and not of trickled candidates.
+func (r sdpReport) isOffer() bool {
+	return r.Session != nil || r.SessionError != ""
+}
+
+func newCandidateReport(c ice.Candidate, store storage) *candidateReport {
+	priority := newPriorityReport(c)
+	report := &candidateReport{
+		Foundation:  c.Foundation,
+		ComponentID: c.ComponentID,
+		Priority:    c.Priority,
+		Address:     c.ConnectionAddress.String(),
+		Port:        c.Port,
+		Transport:   c.Transport.String(),
+		Type:        c.Type.String(),
+		NetworkCost: c.NetworkCost,
+		Generation:  c.Generation,
+		Reflexive:   c.Type == ice.CandidateServerReflexive,
+		MDNS: c.ConnectionAddress.Type == ice.AddressFQDN &&
+			isMDNSName(string(c.ConnectionAddress.Host)),
+
+		PriorityBreakdown: &priority,
+	}
+	if c.RelatedPort != 0 {
+		report.RelatedAddress = c.RelatedAddress.String()
+		report.RelatedPort = c.RelatedPort
+	}
+	if !report.Reflexive {
+		return report
+	}
+	addr := net.JoinHostPort(report.Address, strconv.Itoa(report.Port))
+	history := store.lookup(addr)
+	for i, entry := range history {
+		m := newMessageReport(entry)
+		m.Summary = entry.Message.String()
+		m.Base64 = base64.StdEncoding.EncodeToString(entry.Message.Raw)
+		m.CRC64 = crc64.Checksum(entry.Message.Raw, crc64Table)
+		if i > 0 {
+			m.SincePrevious = entry.CreatedAt.Sub(history[i-1].CreatedAt)
+		}
+		report.Messages = append(report.Messages, m)
+	}
+	return report
+}
+
+// fragmentLinter checks SDP fragments like trickled candidates, which
+// are not complete session descriptions.
+var fragmentLinter = func() lint.Linter {
+	var l lint.Linter
+	for _, r := range lint.DefaultRules {
+		if r.Name != "required-lines" {
+			l.Rules = append(l.Rules, r)
+		}
+	}
+	return l
+}()
+
+// analyzeSDP decodes every line of s, parsing candidates and matching
+// server reflexive ones with messages from store, and verifies
+// candidates against sample remote ones. Obfuscated mDNS candidates
+// are resolved with resolver if it is not nil.
+func analyzeSDP(s sdp.Session, store storage, resolver *mdnsResolver) sdpReport {
+	var (
+		report = sdpReport{
+			Lines: make([]lineReport, 0, len(s)),
+		}
+		candidates []indexedCandidate
+		// unresolved are indexes of mDNS candidates.
+		unresolved []int
+	)
+	for k, v := range s {
+		line := lineReport{
+			Index: k,
+			Key:   string(rune(v.Type)),
+			Type:  v.Type.String(),
+			Value: string(v.Value),
+		}
+		if v.Type == sdp.TypeAttribute && bytes.HasPrefix(v.Value, []byte("candidate")) {
+			var c ice.Candidate
+			if err := ice.ParseAttribute(v.Value, &c); err != nil {
+				line.Candidate = &candidateReport{Error: err.Error()}
+			} else {
+				line.Candidate = newCandidateReport(c, store)
+				if line.Candidate.MDNS && resolver != nil {
+					unresolved = append(unresolved, len(candidates))
+				}
+				candidates = append(candidates, indexedCandidate{Index: k, Candidate: c})
+			}
+		}
+		report.Lines = append(report.Lines, line)
+	}
+	if len(unresolved) > 0 {
+		mdnsCandidates := make([]mdnsCandidate, 0, len(unresolved))
+		for _, i := range unresolved {
+			mdnsCandidates = append(mdnsCandidates, mdnsCandidate{
+				candidate: &candidates[i].Candidate,
+				report:    report.Lines[candidates[i].Index].Candidate,
+			})
+		}
+		resolveCandidates(resolver, mdnsCandidates)
+	}
+	if len(candidates) > 0 {
+		report.Candidates = newCandidatesReport(candidates)
+	}
+	if len(s) == 0 || s[0].Type != sdp.TypeProtocolVersion {
+		report.Problems = fragmentLinter.Lint(s)
+		return report
+	}
+	report.Problems = lint.Lint(s)
+	var (
+		m       sdp.Message
+		decoder = sdp.NewDecoder(s)
+	)
+	if err := decoder.Decode(&m); err != nil {
+		report.SessionError = err.Error()
+		return report
+	}
+	report.Session = newSessionReport(m)
+	return report
+}
+
+// wantsJSON reports whether client prefers JSON to HTML.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// sdpReportTemplate renders sdpReport as HTML fragments for /x/sdp page,
+// escaping all values from SDP and STUN messages.
+var sdpReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+	"dec": func(i int) int { return i - 1 },
+	"clock": func(t time.Time) string {
+		return t.Format("15:04:05.000")
+	},
+	"hostPort": func(host string, port int) string {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	},
+	"join": func(v []string) string {
+		return strings.Join(v, " ")
+	},
+}).Parse(`
+{{- define "parameters" }}
+{{- with .ICE.Ufrag }}
+<p>ice-ufrag: {{ . }}</p>
+{{- end }}
+{{- with .ICE.Pwd }}
+<p>ice-pwd: {{ . }}</p>
+{{- end }}
+{{- with .ICE.Options }}
+<p>ice-options: {{ . }}</p>
+{{- end }}
+{{- if .ICE.Lite }}
+<p>ice-lite</p>
+{{- end }}
+{{- with .DTLS.Fingerprint }}
+<p>fingerprint: {{ . }}</p>
+{{- end }}
+{{- with .DTLS.Setup }}
+<p>setup: {{ . }}</p>
+{{- end }}
+{{- end }}
+{{- with .Session }}
+<div class="sdp-session">
+<p>origin: {{ .Origin }}, name: {{ .Name }}</p>
+{{- range .Groups }}
+<p>group {{ .Semantics }}: {{ join .Mids }}</p>
+{{- end }}
+{{- template "parameters" . }}
+{{- range .Medias }}
+<div class="sdp-media">
+<p class="success">m={{ .Type }} {{ .Port }} {{ .Protocol }} {{ join .Formats }}</p>
+<p>mid: {{ .Mid }}, direction: {{ .Direction }}{{ if .Bundle }}, bundled{{ end }}{{ if .RTCPMux }}, rtcp-mux{{ end }}</p>
+{{- template "parameters" . }}
+{{- range .Codecs }}
+<p>codec {{ .PayloadType }}: {{ .Name }}{{ with .ClockRate }}/{{ . }}{{ end }}{{ with .Channels }}/{{ . }}{{ end }}
+{{- with .Parameters }} fmtp {{ . }}{{ end }}
+{{- with .Feedback }} rtcp-fb {{ join . }}{{ end }}</p>
+{{- end }}
+{{- range .Extmaps }}
+<p>extmap {{ .ID }}: {{ .URI }}</p>
+{{- end }}
+{{- range .SSRCs }}
+<p>ssrc {{ .SSRC }}: {{ join .Attributes }}</p>
+{{- end }}
+{{- range .SSRCGroups }}
+<p>ssrc-group: {{ . }}</p>
+{{- end }}
+</div>
+{{- end }}
+</div>
+{{- end }}
+{{- with .SessionError }}
+<p class="warning">failed to decode as sdp.Message: {{ . }}</p>
+{{- end }}
+{{- with .Problems }}
+<div class="sdp-lint">
+{{- range . }}
+<p class="{{ .Severity }}">{{ if .Line }}{{ printf "%02d" (dec .Line) }} {{ end }}{{ .Severity }}: {{ .Message }} ({{ .Rule }})</p>
+{{- end }}
+</div>
+{{- end }}
+{{- range .Lines }}
+<p class="attribute">{{ printf "%02d" .Index }} {{ .Type }}: {{ .Value }}</p>
+{{- with .Candidate }}
+<div class="stun-message">
+{{- if .Error }}
+<p class="error">failed to parse as candidate: {{ .Error }}</p>
+{{- else }}
+<p>parsed as candidate: foundation={{ .Foundation }} component={{ .ComponentID }} priority={{ .Priority }} address={{ .Address }} port={{ .Port }} transport={{ .Transport }} type={{ .Type }}
+{{- if .RelatedPort }} related={{ hostPort .RelatedAddress .RelatedPort }}{{ end }}</p>
+{{- if .MDNS }}
+<p class="info">host address is obfuscated with mDNS name</p>
+{{- with .Resolved }}
+<p>resolved on local link: {{ join . }}</p>
+{{- end }}
+{{- with .ResolveError }}
+<p class="warning">failed to resolve: {{ . }}</p>
+{{- end }}
+{{- end }}
+{{- with .PriorityBreakdown }}
+<p>priority: type preference {{ .TypePreference }}, local preference {{ .LocalPreference }}, expected {{ .Expected }}</p>
+{{- range .Mismatches }}
+<p class="warning">priority mismatch: {{ . }}</p>
+{{- end }}
+{{- end }}
+{{- if .Reflexive }}
+{{- if .Messages }}
+<p class="success">{{ len .Messages }} binding requests found in STUN log</p>
+{{- range $i, $m := .Messages }}
+<div class="stun-transaction">
+<p>#{{ inc $i }} at {{ clock $m.Time }}{{ if $i }} (+{{ $m.SincePrevious }} after #{{ $i }}){{ end }}: {{ $m.Summary }}</p>
+{{- range $m.Attributes }}
+<p>STUN attribute {{ .Type }}: {{ if .Text }}{{ printf "%q" .Text }}{{ else }}{{ .Value }}{{ end }} (len={{ .Length }})</p>
+{{- end }}
+<p>dumped: <code id="crc64-{{ $m.CRC64 }}">stun-decode {{ $m.Base64 }}</code>
+<button class="btn" data-clipboard-target="#crc64-{{ $m.CRC64 }}">copy</button></p>
+<p>crc64: <code>{{ $m.CRC64 }}</code></p>
+</div>
+{{- end }}
+{{- else }}
+<p class="warning">message from candidate not found in STUN log</p>
+{{- end }}
+{{- end }}
+{{- end }}
+</div>
+{{- end }}
+{{- end }}
+{{- with .Candidates }}
+<div class="sdp-candidates">
+{{- range .Foundations }}
+<p>foundation {{ .Foundation }}: {{ .Type }} {{ .Transport }}, lines {{ range $i, $l := .Lines }}{{ if $i }}, {{ end }}{{ printf "%02d" $l }}{{ end }}</p>
+{{- range .Mismatches }}
+<p class="warning">foundation mismatch: {{ . }}</p>
+{{- end }}
+{{- end }}
+{{- range .Components }}
+<p>component {{ .ComponentID }} pairs against sample remote candidates {{ range $i, $r := .Remote }}{{ if $i }}, {{ end }}{{ $r }}{{ end }}:</p>
+{{- range $i, $p := .Pairs }}
+<p class="stun-transaction">#{{ inc $i }} {{ $p.Local }} &rarr; {{ $p.Remote }} ({{ $p.Type }}) priority={{ $p.Priority }} {{ $p.State }}</p>
+{{- else }}
+<p class="warning">no pairs formed</p>
+{{- end }}
+{{- with .Pruned }}
+<p>{{ . }} redundant pairs pruned</p>
+{{- end }}
+{{- end }}
+</div>
+{{- end }}
+`))
+
+// writeHTML renders report as HTML fragments for /x/sdp page.
+func (report sdpReport) writeHTML(w io.Writer) error {
+	return sdpReportTemplate.Execute(w, report)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gortc/sdp"
+	"github.com/gortc/stun"
+)
+
+// hostileSDP has markup in line values, candidate fields and values
+// that are quoted in lint messages.
+const hostileSDP = `v=0
+o=- 1 2 IN IP4 127.0.0.1
+s=<script>alert(1)</script>
+t=0 0
+a=group:BUNDLE 0 "><img src=x onerror=alert(1)>
+a=ice-ufrag:<b>
+a=ice-pwd:<script>alert(1)</script>'"
+a=fingerprint:<script> 00
+m=audio 9 UDP/TLS/RTP/SAVPF 111 96
+c=IN IP4 0.0.0.0
+a=mid:0
+a=rtpmap:111 <script>/48000/2
+a=fmtp:111 x="><script>alert(1)</script>
+a=ssrc:1 cname:<script>alert(1)</script>
+a=candidate:1 1 udp 2130706431 192.0.2.1 3478 typ srflx raddr 0.0.0.0 rport 0
+a=candidate:<script> 1 udp 1 192.0.2.1 1 typ host
+a=candidate:2 1 udp 1 "><script>.local 1 typ host
+a=candidate:3 1 udp 99999999999 192.0.2.2 1 typ host
+`
+
+// assertEscaped fails if out has unescaped markup of hostileSDP.
+func assertEscaped(t *testing.T, out string) {
+	t.Helper()
+	for _, markup := range []string{"<script", "<img", "<b>", `"><`} {
+		if strings.Contains(out, markup) {
+			t.Errorf("unescaped %q in:\n%s", markup, out)
+		}
+	}
+	if !strings.Contains(out, "&lt;script&gt;") {
+		t.Errorf("no escaped markup in:\n%s", out)
+	}
+}
+
+func hostileReport(t *testing.T) (sdpReport, []byte) {
+	body := []byte(strings.Replace(hostileSDP, "\n", "\r\n", -1))
+	s, err := sdp.DecodeSession(body, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newMemoryStorage(defaultStorageTTL, defaultStorageCapacity)
+	store.add("192.0.2.1:3478", stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+		stun.NewSoftware("<script>alert(1)</script>"),
+		stun.NewUsername(`"><img src=x onerror=alert(1)>`),
+	))
+	return analyzeSDP(s, store, nil), body
+}
+
+func TestSDPReportEscaping(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	report, _ := hostileReport(t)
+	if report.Session == nil || len(report.Problems) == 0 || report.Candidates == nil {
+		t.Fatalf("hostile SDP is not fully analyzed: %+v", report)
+	}
+	buf := new(bytes.Buffer)
+	if err := report.writeHTML(buf); err != nil {
+		t.Fatal(err)
+	}
+	assertEscaped(t, buf.String())
+}
+
+func TestTrickleSessionEscaping(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	report, body := hostileReport(t)
+	sessions := &trickleSessions{sessions: make(map[string]*trickleSession)}
+	session, err := sessions.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.record(session.ID, string(body), report)
+	sessions.recordMessage(session.ID, messageReport{
+		Addr:          "<script>alert(1)</script>",
+		TransactionID: `"><img src=x onerror=alert(1)>`,
+		Type:          "<b>",
+	})
+	buf := new(bytes.Buffer)
+	store := newMemoryStorage(defaultStorageTTL, defaultStorageCapacity)
+	if err = sessions.timeline(session.ID, store).writeHTML(buf); err != nil {
+		t.Fatal(err)
+	}
+	assertEscaped(t, buf.String())
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gortc/sdp"
+)
+
+// codecReport is RTP payload type described by rtpmap, fmtp and
+// rtcp-fb attributes, RFC 4566 Section 6 and RFC 4585 Section 4.2.
+type codecReport struct {
+	PayloadType string   `json:"payload_type"`
+	Name        string   `json:"name,omitempty"`
+	ClockRate   int      `json:"clock_rate,omitempty"`
+	Channels    int      `json:"channels,omitempty"`
+	Parameters  string   `json:"parameters,omitempty"`
+	Feedback    []string `json:"feedback,omitempty"`
+}
+
+// extmapReport is RTP header extension, RFC 8285 Section 8.
+type extmapReport struct {
+	ID  string `json:"id"`
+	URI string `json:"uri"`
+}
+
+// ssrcReport is RTP source with its attributes, RFC 5576 Section 4.1.
+type ssrcReport struct {
+	SSRC       string   `json:"ssrc"`
+	Attributes []string `json:"attributes"`
+}
+
+// iceParametersReport is ICE parameters of session or media.
+type iceParametersReport struct {
+	Ufrag   string `json:"ufrag,omitempty"`
+	Pwd     string `json:"pwd,omitempty"`
+	Options string `json:"options,omitempty"`
+	Lite    bool   `json:"lite,omitempty"`
+}
+
+// dtlsReport is DTLS parameters of session or media, RFC 8122.
+type dtlsReport struct {
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Setup       string `json:"setup,omitempty"`
+}
+
+// groupReport is media grouping, e.g. BUNDLE, RFC 5888 Section 5.
+type groupReport struct {
+	Semantics string   `json:"semantics"`
+	Mids      []string `json:"mids"`
+}
+
+// mediaReport is single m= section.
+type mediaReport struct {
+	Index    int      `json:"index"`
+	Type     string   `json:"type"`
+	Port     int      `json:"port"`
+	Protocol string   `json:"protocol"`
+	Formats  []string `json:"formats"`
+
+	Mid       string `json:"mid,omitempty"`
+	Direction string `json:"direction"`
+	// Bundle is true if mid is in BUNDLE group.
+	Bundle  bool `json:"bundle,omitempty"`
+	RTCPMux bool `json:"rtcp_mux,omitempty"`
+
+	Codecs     []codecReport       `json:"codecs,omitempty"`
+	Extmaps    []extmapReport      `json:"extmaps,omitempty"`
+	SSRCs      []ssrcReport        `json:"ssrcs,omitempty"`
+	SSRCGroups []string            `json:"ssrc_groups,omitempty"`
+	ICE        iceParametersReport `json:"ice"`
+	DTLS       dtlsReport          `json:"dtls"`
+}
+
+// sessionReport is breakdown of SDP decoded as sdp.Message.
+type sessionReport struct {
+	Origin string              `json:"origin"`
+	Name   string              `json:"name"`
+	Groups []groupReport       `json:"groups,omitempty"`
+	ICE    iceParametersReport `json:"ice"`
+	DTLS   dtlsReport          `json:"dtls"`
+	Medias []mediaReport       `json:"medias"`
+}
+
+var directions = []string{"sendrecv", "sendonly", "recvonly", "inactive"}
+
+// direction returns direction flag from attributes or empty string.
+func direction(a sdp.Attributes) string {
+	for _, d := range directions {
+		if a.Flag(d) {
+			return d
+		}
+	}
+	return ""
+}
+
+// splitFirst splits v on first space.
+func splitFirst(v string) (string, string) {
+	idx := strings.Index(v, " ")
+	if idx < 0 {
+		return v, ""
+	}
+	return v[:idx], strings.TrimSpace(v[idx+1:])
+}
+
+func newICEParametersReport(a sdp.Attributes) iceParametersReport {
+	return iceParametersReport{
+		Ufrag:   a.Value("ice-ufrag"),
+		Pwd:     a.Value("ice-pwd"),
+		Options: a.Value("ice-options"),
+		Lite:    a.Flag("ice-lite"),
+	}
+}
+
+func newDTLSReport(a sdp.Attributes) dtlsReport {
+	return dtlsReport{
+		Fingerprint: a.Value("fingerprint"),
+		Setup:       a.Value("setup"),
+	}
+}
+
+// newCodecReports returns codecs for every payload type in formats.
+func newCodecReports(formats []string, a sdp.Attributes) []codecReport {
+	var (
+		codecs  = make([]codecReport, 0, len(formats))
+		byType  = make(map[string]int, len(formats))
+		isRTPPT = func(f string) bool {
+			_, err := strconv.Atoi(f)
+			return err == nil
+		}
+	)
+	for _, f := range formats {
+		if !isRTPPT(f) {
+			// Not RTP media, e.g. webrtc-datachannel.
+			return nil
+		}
+		byType[f] = len(codecs)
+		codecs = append(codecs, codecReport{PayloadType: f})
+	}
+	for _, v := range a.Values("rtpmap") {
+		pt, encoding := splitFirst(v)
+		i, ok := byType[pt]
+		if !ok {
+			continue
+		}
+		// <encoding name>/<clock rate>[/<encoding parameters>]
+		parts := strings.Split(encoding, "/")
+		codecs[i].Name = parts[0]
+		if len(parts) > 1 {
+			codecs[i].ClockRate, _ = strconv.Atoi(parts[1])
+		}
+		if len(parts) > 2 {
+			codecs[i].Channels, _ = strconv.Atoi(parts[2])
+		}
+	}
+	for _, v := range a.Values("fmtp") {
+		pt, params := splitFirst(v)
+		if i, ok := byType[pt]; ok {
+			codecs[i].Parameters = params
+		}
+	}
+	for _, v := range a.Values("rtcp-fb") {
+		pt, feedback := splitFirst(v)
+		if pt == "*" {
+			for i := range codecs {
+				codecs[i].Feedback = append(codecs[i].Feedback, feedback)
+			}
+			continue
+		}
+		if i, ok := byType[pt]; ok {
+			codecs[i].Feedback = append(codecs[i].Feedback, feedback)
+		}
+	}
+	return codecs
+}
+
+func newSSRCReports(a sdp.Attributes) []ssrcReport {
+	var (
+		ssrcs  []ssrcReport
+		bySSRC = make(map[string]int)
+	)
+	for _, v := range a.Values("ssrc") {
+		ssrc, attribute := splitFirst(v)
+		i, ok := bySSRC[ssrc]
+		if !ok {
+			i = len(ssrcs)
+			bySSRC[ssrc] = i
+			ssrcs = append(ssrcs, ssrcReport{SSRC: ssrc})
+		}
+		if len(attribute) > 0 {
+			ssrcs[i].Attributes = append(ssrcs[i].Attributes, attribute)
+		}
+	}
+	return ssrcs
+}
+
+// newSessionReport returns breakdown of m.
+func newSessionReport(m sdp.Message) *sessionReport {
+	r := &sessionReport{
+		Origin: strings.Join([]string{
+			m.Origin.Username,
+			strconv.Itoa(m.Origin.SessionID),
+			strconv.Itoa(m.Origin.SessionVersion),
+			m.Origin.NetworkType, m.Origin.AddressType, m.Origin.Address,
+		}, " "),
+		Name:   m.Name,
+		ICE:    newICEParametersReport(m.Attributes),
+		DTLS:   newDTLSReport(m.Attributes),
+		Medias: make([]mediaReport, 0, len(m.Medias)),
+	}
+	bundled := make(map[string]bool)
+	for _, v := range m.Attributes.Values("group") {
+		fields := strings.Fields(v)
+		if len(fields) == 0 {
+			continue
+		}
+		g := groupReport{Semantics: fields[0], Mids: fields[1:]}
+		if g.Semantics == "BUNDLE" {
+			for _, mid := range g.Mids {
+				bundled[mid] = true
+			}
+		}
+		r.Groups = append(r.Groups, g)
+	}
+	sessionDirection := direction(m.Attributes)
+	for i, media := range m.Medias {
+		formats := strings.Fields(media.Description.Format)
+		mr := mediaReport{
+			Index:      i,
+			Type:       media.Description.Type,
+			Port:       media.Description.Port,
+			Protocol:   media.Description.Protocol,
+			Formats:    formats,
+			Mid:        media.Attribute("mid"),
+			Direction:  direction(media.Attributes),
+			RTCPMux:    media.Flag("rtcp-mux"),
+			Codecs:     newCodecReports(formats, media.Attributes),
+			SSRCs:      newSSRCReports(media.Attributes),
+			SSRCGroups: media.Attributes.Values("ssrc-group"),
+			ICE:        newICEParametersReport(media.Attributes),
+			DTLS:       newDTLSReport(media.Attributes),
+		}
+		mr.Bundle = len(mr.Mid) > 0 && bundled[mr.Mid]
+		if len(mr.Direction) == 0 {
+			// Direction is inherited from session, RFC 4566 Section 6.
+			mr.Direction = sessionDirection
+		}
+		if len(mr.Direction) == 0 {
+			mr.Direction = "sendrecv"
+		}
+		for _, v := range media.Attributes.Values("extmap") {
+			id, uri := splitFirst(v)
+			mr.Extmaps = append(mr.Extmaps, extmapReport{ID: id, URI: uri})
+		}
+		r.Medias = append(r.Medias, mr)
+	}
+	return r
+}
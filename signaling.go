@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gortc/sdp"
+	"golang.org/x/net/websocket"
+)
+
+// Types of signaling messages.
+const (
+	// Sent by clients and relayed to peer in room.
+	signalOffer           = "offer"
+	signalAnswer          = "answer"
+	signalCandidate       = "candidate"
+	signalEndOfCandidates = "end-of-candidates"
+
+	// Sent by server.
+	signalReport     = "report"
+	signalSTUN       = "stun"
+	signalPeerJoined = "peer-joined"
+	signalPeerLeft   = "peer-left"
+	signalError      = "error"
+)
+
+// signalingRoomSize is number of peers paired in room.
+const signalingRoomSize = 2
+
+var (
+	errRoomFull          = errors.New("room is full")
+	errUnknownSignalType = errors.New("unknown message type")
+)
+
+// signalingMessage is JSON message of WebSocket signaling channel.
+type signalingMessage struct {
+	Type string `json:"type"`
+	// SDP is offer or answer.
+	SDP string `json:"sdp,omitempty"`
+	// Candidate is candidate attribute value, e.g. RTCIceCandidate.candidate.
+	Candidate string `json:"candidate,omitempty"`
+	Mid       string `json:"mid,omitempty"`
+
+	// Session is trickle session of client, viewable at /x/sdp/session/.
+	Session string `json:"session,omitempty"`
+	// Report is analysis of SDP sent by client, HTML is its rendering
+	// as on /x/sdp page.
+	Report  *sdpReport     `json:"report,omitempty"`
+	HTML    string         `json:"html,omitempty"`
+	Message *messageReport `json:"message,omitempty"`
+	// Initiator is true for peer that should send offer.
+	Initiator bool   `json:"initiator,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// signalingPeer is WebSocket client.
+type signalingPeer struct {
+	conn *websocket.Conn
+	// mux serializes writes to conn.
+	mux sync.Mutex
+
+	// state is guarded by stateMux.
+	stateMux sync.Mutex
+	session  string
+	// reflexive are addresses of server reflexive candidates, up to
+	// trickleMaxReflexive.
+	reflexive map[string]bool
+	// userAgent is User-Agent header of WebSocket handshake.
+	userAgent string
+}
+
+func (p *signalingPeer) send(m signalingMessage) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return websocket.JSON.Send(p.conn, m)
+}
+
+func (p *signalingPeer) sendError(err error) {
+	if sendErr := p.send(signalingMessage{Type: signalError, Error: err.Error()}); sendErr != nil {
+		log.Println("ws: failed to send error:", sendErr)
+	}
+}
+
+// signalingRooms pairs peers by room name.
+type signalingRooms struct {
+	mux   sync.Mutex
+	rooms map[string][]*signalingPeer
+}
+
+var rooms = &signalingRooms{
+	rooms: make(map[string][]*signalingPeer),
+}
+
+// join adds p to room and notifies both peers if room became full.
+func (r *signalingRooms) join(name string, p *signalingPeer) error {
+	r.mux.Lock()
+	peers := r.rooms[name]
+	if len(peers) >= signalingRoomSize {
+		r.mux.Unlock()
+		return errRoomFull
+	}
+	r.rooms[name] = append(peers, p)
+	r.mux.Unlock()
+	if len(peers) == 0 {
+		return nil
+	}
+	// Peer that waited in room is initiator.
+	if err := peers[0].send(signalingMessage{Type: signalPeerJoined, Initiator: true}); err != nil {
+		log.Println("ws: failed to notify peer:", err)
+	}
+	return p.send(signalingMessage{Type: signalPeerJoined})
+}
+
+// leave removes p from room and notifies remaining peer.
+func (r *signalingRooms) leave(name string, p *signalingPeer) {
+	r.mux.Lock()
+	var left []*signalingPeer
+	for _, peer := range r.rooms[name] {
+		if peer != p {
+			left = append(left, peer)
+		}
+	}
+	if len(left) == 0 {
+		delete(r.rooms, name)
+	} else {
+		r.rooms[name] = left
+	}
+	r.mux.Unlock()
+	for _, peer := range left {
+		if err := peer.send(signalingMessage{Type: signalPeerLeft}); err != nil {
+			log.Println("ws: failed to notify peer:", err)
+		}
+	}
+}
+
+// peer returns other peer in room or nil.
+func (r *signalingRooms) peer(name string, p *signalingPeer) *signalingPeer {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, peer := range r.rooms[name] {
+		if peer != p {
+			return peer
+		}
+	}
+	return nil
+}
+
+// signalingSDP returns SDP lines carried by message.
+func signalingSDP(m signalingMessage) (string, error) {
+	switch m.Type {
+	case signalOffer, signalAnswer:
+		return m.SDP, nil
+	case signalCandidate:
+		return "a=" + strings.TrimPrefix(m.Candidate, "a="), nil
+	case signalEndOfCandidates:
+		return "a=end-of-candidates", nil
+	default:
+		return "", errUnknownSignalType
+	}
+}
+
+// analyze reports SDP of m to p, recording it to trickle session.
+func (p *signalingPeer) analyze(m signalingMessage) error {
+	body, err := signalingSDP(m)
+	if err != nil {
+		return err
+	}
+	s, err := sdp.DecodeSession([]byte(body), nil)
+	if err != nil {
+		return err
+	}
+	p.stateMux.Lock()
+	session := p.session
+	p.stateMux.Unlock()
+	// Messages of peer are analyzed sequentially, so session can't be
+	// created concurrently.
+	report := reportSDP(s, body, session, p.userAgent)
+	p.stateMux.Lock()
+	p.session = report.SessionID
+	for _, line := range report.Lines {
+		c := line.Candidate
+		if c == nil || !c.Reflexive || len(p.reflexive) >= trickleMaxReflexive {
+			continue
+		}
+		p.reflexive[net.JoinHostPort(c.Address, strconv.Itoa(c.Port))] = true
+	}
+	p.stateMux.Unlock()
+	buf := new(bytes.Buffer)
+	if err = report.writeHTML(buf); err != nil {
+		return err
+	}
+	return p.send(signalingMessage{
+		Type:    signalReport,
+		Session: report.SessionID,
+		Report:  &report,
+		HTML:    buf.String(),
+	})
+}
+
+// pushSTUN sends captured STUN transactions from client IP or server
+// reflexive candidates of p until events are closed.
+func (p *signalingPeer) pushSTUN(events <-chan storedMessage, client net.IP) {
+	for entry := range events {
+		host, _, err := net.SplitHostPort(entry.Addr)
+		if err != nil {
+			continue
+		}
+		p.stateMux.Lock()
+		var (
+			session = p.session
+			matched = p.reflexive[entry.Addr] || client.Equal(net.ParseIP(host))
+		)
+		p.stateMux.Unlock()
+		if !matched {
+			continue
+		}
+		m := newMessageReport(entry)
+		if session != "" {
+			trickle.recordMessage(session, m)
+		}
+		if err = p.send(signalingMessage{Type: signalSTUN, Session: session, Message: &m}); err != nil {
+			log.Println("ws: failed to push STUN message:", err)
+		}
+	}
+}
+
+// clientIP returns address of client that sent r. Requests from
+// loopback are proxied by nginx, so last address of X-Forwarded-For,
+// which is added by proxy, is used for them.
+func clientIP(r *http.Request) net.IP {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if ip == nil || !ip.IsLoopback() || forwarded == "" {
+		return ip
+	}
+	addrs := strings.Split(forwarded, ",")
+	if proxied := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1])); proxied != nil {
+		return proxied
+	}
+	return ip
+}
+
+// serveSignaling handles WebSocket signaling channel. Every offer,
+// answer and candidate is analyzed like on /x/sdp and relayed to other
+// peer in room from "room" query parameter, if any.
+func serveSignaling(ws *websocket.Conn) {
+	defer ws.Close()
+	var (
+		r    = ws.Request()
+		room = r.URL.Query().Get("room")
+		peer = &signalingPeer{
+			conn:      ws,
+			reflexive: make(map[string]bool),
+			userAgent: r.Header.Get("User-agent"),
+		}
+	)
+	log.Println("ws: connected", r.RemoteAddr, "room", room)
+	defer log.Println("ws: disconnected", r.RemoteAddr)
+	if room != "" {
+		if err := rooms.join(room, peer); err != nil {
+			peer.sendError(err)
+			return
+		}
+		defer rooms.leave(room, peer)
+	}
+	events, cancel := messages.subscribe()
+	defer cancel()
+	go peer.pushSTUN(events, clientIP(r))
+	for {
+		var m signalingMessage
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			if err != io.EOF {
+				log.Println("ws: failed to receive:", err)
+			}
+			return
+		}
+		if err := peer.analyze(m); err != nil {
+			log.Println("ws: failed to analyze:", err)
+			peer.sendError(err)
+			continue
+		}
+		if room == "" {
+			continue
+		}
+		if other := rooms.peer(room, peer); other != nil {
+			if err := other.send(m); err != nil {
+				log.Println("ws: failed to relay:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gortc/stun"
+	"golang.org/x/net/websocket"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		remote    string
+		forwarded string
+		ip        string
+	}{
+		{remote: "203.0.113.1:1000", ip: "203.0.113.1"},
+		// Only proxy on loopback is trusted.
+		{remote: "203.0.113.1:1000", forwarded: "198.51.100.1", ip: "203.0.113.1"},
+		{remote: "127.0.0.1:1000", ip: "127.0.0.1"},
+		{remote: "127.0.0.1:1000", forwarded: "198.51.100.1", ip: "198.51.100.1"},
+		{remote: "[::1]:1000", forwarded: "2001:db8::1", ip: "2001:db8::1"},
+		// Addresses before last one are sent by client.
+		{remote: "127.0.0.1:1000", forwarded: "192.0.2.1, 198.51.100.1", ip: "198.51.100.1"},
+		{remote: "127.0.0.1:1000", forwarded: "bad", ip: "127.0.0.1"},
+	} {
+		r := &http.Request{RemoteAddr: tc.remote, Header: make(http.Header)}
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if ip := clientIP(r); !ip.Equal(net.ParseIP(tc.ip)) {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", tc.remote, tc.forwarded, ip, tc.ip)
+		}
+	}
+}
+
+func TestServeSignaling(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	store := newMemoryStorage(defaultStorageTTL, defaultStorageCapacity)
+	store.add("192.0.2.1:3478", stun.MustBuild(stun.TransactionID, stun.BindingRequest))
+	buf := new(bytes.Buffer)
+	defer func(s storage, l *packetLog) { messages, packets = s, l }(messages, packets)
+	messages, packets = store, newPacketLog(buf, defaultStorageTTL)
+	server := httptest.NewServer(websocket.Handler(serveSignaling))
+	defer server.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	// Report is not decoded, because lint problems can't be unmarshaled.
+	type report struct {
+		Type    string `json:"type"`
+		Session string `json:"session"`
+		Error   string `json:"error"`
+	}
+	exchange := func(m signalingMessage) report {
+		t.Helper()
+		if err := websocket.JSON.Send(ws, m); err != nil {
+			t.Fatal(err)
+		}
+		var res report
+		if err := websocket.JSON.Receive(ws, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Type != signalReport {
+			t.Fatalf("unexpected %s: %s", res.Type, res.Error)
+		}
+		return res
+	}
+	candidate := "candidate:1 1 udp 1694498815 192.0.2.1 3478 typ srflx raddr 10.0.0.1 rport 1000"
+	// Candidate before offer doesn't start session.
+	if res := exchange(signalingMessage{Type: signalCandidate, Candidate: candidate}); res.Session != "" {
+		t.Errorf("session %s is started by candidate", res.Session)
+	}
+	offer := exchange(signalingMessage{Type: signalOffer, SDP: strings.Join([]string{
+		"v=0",
+		"o=- 1 2 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"c=IN IP4 0.0.0.0",
+		"a=" + candidate,
+		"",
+	}, "\r\n")})
+	if offer.Session == "" {
+		t.Fatal("no session")
+	}
+	if res := exchange(signalingMessage{Type: signalCandidate, Candidate: candidate}); res.Session != offer.Session {
+		t.Errorf("session %q, expected %q", res.Session, offer.Session)
+	}
+	// Message is logged once, though it is reported three times.
+	records, err := csv.NewReader(bytes.NewReader(buf.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0][0] != "192.0.2.1:3478" {
+		t.Errorf("unexpected packet log: %v", records)
+	}
+}
@@ -1,33 +1,52 @@
 package main
 
 import (
+	"container/list"
+	"expvar"
+	"hash/fnv"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gortc/stun"
 )
 
-var messages = &storage{
-	data: make(map[string]*storageEntry),
+// storage stores history of STUN messages captured by source address,
+// so they can be matched with server reflexive candidates.
+type storage interface {
+	// add saves copy of m received from addr, retransmissions of
+	// already stored transaction are ignored.
+	add(addr string, m *stun.Message)
+	// lookup returns messages from addr ordered by capture time.
+	lookup(addr string) []storedMessage
+	// list returns all stored messages ordered by capture time.
+	list() []storedMessage
+	// subscribe returns channel of added messages and function that
+	// cancels subscription.
+	subscribe() (<-chan storedMessage, func())
+	// collect removes expired messages.
+	collect()
 }
 
-type storageEntry struct {
-	*stun.Message
-	createdAt time.Time
-}
+// Defaults for captured STUN messages storage.
+const (
+	defaultStorageTTL      = time.Second * 60
+	defaultStorageCapacity = 10000
+	storageGCInterval      = time.Second * 2
+)
 
-func (s storageEntry) timedOut(timeout time.Time) bool {
-	return s.createdAt.Before(timeout)
-}
+var messages storage = newMemoryStorage(defaultStorageTTL, defaultStorageCapacity)
 
-type storage struct {
-	data map[string]*storageEntry
-	sync.Mutex
+// storedMessage is STUN message captured from addr.
+type storedMessage struct {
+	Addr      string
+	Message   *stun.Message
+	CreatedAt time.Time
 }
 
-func (storage) timeout() time.Time {
-	return time.Now().Add(time.Second * -60)
+func (s storedMessage) timedOut(timeout time.Time) bool {
+	return s.CreatedAt.Before(timeout)
 }
 
 func mustClone(m *stun.Message) *stun.Message {
@@ -38,53 +57,244 @@ func mustClone(m *stun.Message) *stun.Message {
 	return b
 }
 
-func (s *storage) pop(addr string) *stun.Message {
-	s.Lock()
-	defer s.Unlock()
-	if s.data[addr] == nil {
-		return nil
+func sortMessages(list []storedMessage) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+}
+
+// collectStorage periodically removes expired messages from s.
+func collectStorage(s storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		s.collect()
 	}
-	m := mustClone(s.data[addr].Message)
-	delete(s.data, addr)
-	return m
 }
 
-func (s *storage) add(addr string, m *stun.Message) {
-	c := new(stun.Message)
-	m.CloneTo(c)
-	entry := &storageEntry{
-		Message:   c,
-		createdAt: time.Now(),
+// subscriptions broadcasts added messages to subscribers.
+type subscriptions struct {
+	mux  sync.Mutex
+	subs map[chan storedMessage]struct{}
+}
+
+// subscriptionBuffer is size of subscriber channel buffer; messages
+// are dropped for subscribers that are not keeping up.
+const subscriptionBuffer = 16
+
+func (s *subscriptions) subscribe() (<-chan storedMessage, func()) {
+	c := make(chan storedMessage, subscriptionBuffer)
+	s.mux.Lock()
+	if s.subs == nil {
+		s.subs = make(map[chan storedMessage]struct{})
+	}
+	s.subs[c] = struct{}{}
+	s.mux.Unlock()
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			s.mux.Lock()
+			delete(s.subs, c)
+			s.mux.Unlock()
+			close(c)
+		})
 	}
-	s.Lock()
-	s.data[addr] = entry
-	s.Unlock()
-	log.Println("storage: added", addr)
 }
 
-func (s *storage) collect() {
-	s.Lock()
+func (s *subscriptions) publish(m storedMessage) {
+	s.mux.Lock()
+	for c := range s.subs {
+		select {
+		case c <- m:
+		default:
+		}
+	}
+	s.mux.Unlock()
+}
+
+// storageShards is maximum number of independently locked parts of
+// in-memory storage, reducing lock contention of concurrent workers.
+const storageShards = 16
+
+var storageStats = expvar.NewMap("stun_storage")
+
+// storageKey identifies stored transaction.
+type storageKey struct {
+	addr string
+	id   [stun.TransactionIDSize]byte
+}
+
+// memoryShard is part of in-memory storage with own lock and LRU list,
+// where front is most recently added or looked up message.
+type memoryShard struct {
+	mux      sync.Mutex
+	entries  map[storageKey]*list.Element // values are storedMessage
+	addrs    map[string][]*list.Element   // ordered by capture time
+	lru      *list.List
+	capacity int
+}
+
+// memoryStorage is in-memory storage, messages are lost on restart.
+//
+// When capacity is reached, least recently used messages are evicted,
+// so flood of spoofed sources can't grow storage unbounded, while
+// messages that are looked up by analyzer are kept.
+type memoryStorage struct {
+	subscriptions
+
+	ttl time.Duration
+	// now is clock of storage, replaceable in tests.
+	now func() time.Time
+
+	// shards split capacity evenly.
+	shards []memoryShard
+}
+
+// newMemoryStorage returns in-memory storage that keeps up to capacity
+// messages for ttl.
+func newMemoryStorage(ttl time.Duration, capacity int) *memoryStorage {
+	shards := storageShards
+	if capacity < shards {
+		shards = capacity
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	s := &memoryStorage{
+		ttl:    ttl,
+		now:    time.Now,
+		shards: make([]memoryShard, shards),
+	}
+	shardCapacity := (capacity + shards - 1) / shards
+	if shardCapacity < 1 {
+		shardCapacity = 1
+	}
+	for i := range s.shards {
+		s.shards[i].entries = make(map[storageKey]*list.Element)
+		s.shards[i].addrs = make(map[string][]*list.Element)
+		s.shards[i].lru = list.New()
+		s.shards[i].capacity = shardCapacity
+	}
+	return s
+}
+
+func (s *memoryStorage) shard(addr string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(addr))
+	return &s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *memoryStorage) lookup(addr string) []storedMessage {
 	var (
-		toRemove = make([]string, 0, 10)
-		timeout  = s.timeout()
+		shard   = s.shard(addr)
+		timeout = s.now().Add(-s.ttl)
+		result  []storedMessage
 	)
-	for addr, m := range s.data {
-		if m.timedOut(timeout) {
-			toRemove = append(toRemove, addr)
+	shard.mux.Lock()
+	for _, e := range shard.addrs[addr] {
+		entry := e.Value.(storedMessage)
+		if entry.timedOut(timeout) {
+			continue
 		}
+		shard.lru.MoveToFront(e)
+		entry.Message = mustClone(entry.Message)
+		result = append(result, entry)
+	}
+	shard.mux.Unlock()
+	if len(result) == 0 {
+		storageStats.Add("miss", 1)
+	} else {
+		storageStats.Add("hit", 1)
 	}
-	for _, addr := range toRemove {
-		delete(s.data, addr)
+	return result
+}
+
+func keyOf(e storedMessage) storageKey {
+	return storageKey{addr: e.Addr, id: e.Message.TransactionID}
+}
+
+func (shard *memoryShard) remove(e *list.Element) {
+	entry := e.Value.(storedMessage)
+	shard.lru.Remove(e)
+	delete(shard.entries, keyOf(entry))
+	history := shard.addrs[entry.Addr]
+	for i := range history {
+		if history[i] == e {
+			history = append(history[:i], history[i+1:]...)
+			break
+		}
 	}
-	s.Unlock()
-	if len(toRemove) > 0 {
-		log.Println("storage: collected", len(toRemove))
+	if len(history) == 0 {
+		delete(shard.addrs, entry.Addr)
+	} else {
+		shard.addrs[entry.Addr] = history
 	}
+	storageStats.Add("size", -1)
 }
 
-func (s *storage) gc() {
-	ticker := time.NewTicker(time.Second * 2)
-	for range ticker.C {
-		s.collect()
+func (s *memoryStorage) add(addr string, m *stun.Message) {
+	entry := storedMessage{
+		Addr:      addr,
+		Message:   mustClone(m),
+		CreatedAt: s.now(),
+	}
+	key := keyOf(entry)
+	shard := s.shard(addr)
+	shard.mux.Lock()
+	if _, ok := shard.entries[key]; ok {
+		shard.mux.Unlock()
+		return
+	}
+	if shard.lru.Len() >= shard.capacity {
+		evicted := shard.lru.Back()
+		shard.remove(evicted)
+		storageStats.Add("eviction", 1)
+		log.Println("storage: evicted", evicted.Value.(storedMessage).Addr)
+	}
+	e := shard.lru.PushFront(entry)
+	shard.entries[key] = e
+	shard.addrs[addr] = append(shard.addrs[addr], e)
+	storageStats.Add("size", 1)
+	shard.mux.Unlock()
+	log.Println("storage: added", addr)
+	s.publish(entry)
+}
+
+func (s *memoryStorage) list() []storedMessage {
+	var result []storedMessage
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mux.Lock()
+		for e := shard.lru.Front(); e != nil; e = e.Next() {
+			entry := e.Value.(storedMessage)
+			entry.Message = mustClone(entry.Message)
+			result = append(result, entry)
+		}
+		shard.mux.Unlock()
+	}
+	sortMessages(result)
+	return result
+}
+
+func (s *memoryStorage) collect() {
+	var (
+		collected int
+		timeout   = s.now().Add(-s.ttl)
+	)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mux.Lock()
+		// Messages are ordered by last use, not by capture time.
+		for e := shard.lru.Front(); e != nil; {
+			next := e.Next()
+			if e.Value.(storedMessage).timedOut(timeout) {
+				shard.remove(e)
+				collected++
+			}
+			e = next
+		}
+		shard.mux.Unlock()
+	}
+	if collected > 0 {
+		log.Println("storage: collected", collected)
 	}
 }
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gortc/stun"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Limits of bbolt storage write queue.
+const (
+	// boltWriteQueue is number of messages waiting for writer, new
+	// messages are dropped if writer is not keeping up with disk.
+	boltWriteQueue = 1024
+	// boltMaxBatch is maximum number of messages in single transaction.
+	boltMaxBatch = 256
+)
+
+var (
+	boltHistoryBucket = []byte("history")
+	boltOrderBucket   = []byte("order")
+
+	errBadBoltEntry = errors.New("bad storage entry")
+)
+
+// boltStorage is on-disk storage in bbolt database, so captured
+// messages survive restarts.
+//
+// Every source address has nested bucket of messages keyed by
+// transaction ID. Values are capture time as big-endian unix
+// nanoseconds followed by raw STUN message.
+//
+// Order bucket indexes messages by capture time followed by
+// transaction ID, with source address as value. When capacity is
+// reached, oldest messages are evicted by index, so flood of spoofed
+// sources can't block new captures. Unlike in-memory storage, lookup
+// does not refresh messages, because it would require write.
+//
+// Messages are queued and written in batches by single writer, so STUN
+// workers never wait on disk.
+type boltStorage struct {
+	subscriptions
+
+	db       *bolt.DB
+	ttl      time.Duration
+	capacity int
+	// now is clock of storage, replaceable in tests.
+	now func() time.Time
+
+	writes chan storedMessage
+	// written is closed when writer is stopped.
+	written chan struct{}
+
+	// mux serializes capacity checks with count updates.
+	mux   sync.Mutex
+	count int
+}
+
+// newBoltStorage opens bbolt database at path and returns storage that
+// keeps up to capacity messages for ttl.
+func newBoltStorage(path string, ttl time.Duration, capacity int) (*boltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStorage{
+		db:       db,
+		ttl:      ttl,
+		capacity: capacity,
+		now:      time.Now,
+		writes:   make(chan storedMessage, boltWriteQueue),
+		written:  make(chan struct{}),
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		history, err := tx.CreateBucketIfNotExists(boltHistoryBucket)
+		if err != nil {
+			return err
+		}
+		order, err := tx.CreateBucketIfNotExists(boltOrderBucket)
+		if err != nil {
+			return err
+		}
+		// Nested buckets are counted as keys too.
+		stats := history.Stats()
+		s.count = stats.KeyN - stats.BucketN + 1
+		if order.Stats().KeyN != s.count {
+			// Database is created by version without index.
+			if s.count, err = indexBoltEntries(tx); err != nil {
+				return err
+			}
+		}
+		storageStats.Add("size", int64(s.count))
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go s.write()
+	return s, nil
+}
+
+// Close writes queued messages and closes database. Messages must not
+// be added after Close.
+func (s *boltStorage) Close() error {
+	close(s.writes)
+	<-s.written
+	return s.db.Close()
+}
+
+func encodeBoltEntry(createdAt time.Time, m *stun.Message) []byte {
+	v := make([]byte, 8+len(m.Raw))
+	binary.BigEndian.PutUint64(v, uint64(createdAt.UnixNano()))
+	copy(v[8:], m.Raw)
+	return v
+}
+
+// boltOrderKey returns key of order index for message id captured at
+// createdAt.
+func boltOrderKey(createdAt time.Time, id []byte) []byte {
+	k := make([]byte, 8+len(id))
+	binary.BigEndian.PutUint64(k, uint64(createdAt.UnixNano()))
+	copy(k[8:], id)
+	return k
+}
+
+// indexBoltEntries re-creates order index, removing entries that can't
+// be decoded, and returns number of indexed entries.
+func indexBoltEntries(tx *bolt.Tx) (int, error) {
+	if err := tx.DeleteBucket(boltOrderBucket); err != nil {
+		return 0, err
+	}
+	order, err := tx.CreateBucket(boltOrderBucket)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		history = tx.Bucket(boltHistoryBucket)
+		addrs   [][]byte
+	)
+	if err = history.ForEach(func(addr, _ []byte) error {
+		addrs = append(addrs, append([]byte(nil), addr...))
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, addr := range addrs {
+		b := history.Bucket(addr)
+		if b == nil {
+			continue
+		}
+		var bad [][]byte
+		if err = b.ForEach(func(k, v []byte) error {
+			entry, err := decodeBoltEntry(addr, v)
+			if err != nil {
+				bad = append(bad, append([]byte(nil), k...))
+				return nil
+			}
+			count++
+			return order.Put(boltOrderKey(entry.CreatedAt, k), addr)
+		}); err != nil {
+			return 0, err
+		}
+		for _, k := range bad {
+			if err = b.Delete(k); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return count, nil
+}
+
+// removeBoltEntry removes message by key of order index, deleting
+// bucket of source address if it becomes empty.
+func removeBoltEntry(tx *bolt.Tx, k, addr []byte) error {
+	// Copying key and address, because they are invalidated by delete.
+	k = append([]byte(nil), k...)
+	addr = append([]byte(nil), addr...)
+	history := tx.Bucket(boltHistoryBucket)
+	if err := tx.Bucket(boltOrderBucket).Delete(k); err != nil {
+		return err
+	}
+	b := history.Bucket(addr)
+	if b == nil {
+		return nil
+	}
+	if err := b.Delete(k[8:]); err != nil {
+		return err
+	}
+	if k, _ := b.Cursor().First(); k == nil {
+		return history.DeleteBucket(addr)
+	}
+	return nil
+}
+
+func decodeBoltEntry(addr, v []byte) (storedMessage, error) {
+	if len(v) < 8 {
+		return storedMessage{}, errBadBoltEntry
+	}
+	m := new(stun.Message)
+	// Copying raw message because v is valid only during transaction.
+	if _, err := m.Write(v[8:]); err != nil {
+		return storedMessage{}, err
+	}
+	return storedMessage{
+		Addr:      string(addr),
+		Message:   m,
+		CreatedAt: time.Unix(0, int64(binary.BigEndian.Uint64(v))),
+	}, nil
+}
+
+func (s *boltStorage) add(addr string, m *stun.Message) {
+	entry := storedMessage{
+		Addr:      addr,
+		Message:   mustClone(m),
+		CreatedAt: s.now(),
+	}
+	select {
+	case s.writes <- entry:
+	default:
+		storageStats.Add("dropped", 1)
+		log.Println("storage: write queue is full, dropped", addr)
+	}
+}
+
+// write writes queued messages until writes channel is closed.
+func (s *boltStorage) write() {
+	defer close(s.written)
+	for entry := range s.writes {
+		// Messages that were queued meanwhile share single transaction.
+		batch := []storedMessage{entry}
+	queued:
+		for len(batch) < boltMaxBatch {
+			select {
+			case entry, ok := <-s.writes:
+				if !ok {
+					break queued
+				}
+				batch = append(batch, entry)
+			default:
+				break queued
+			}
+		}
+		s.writeBatch(batch)
+	}
+}
+
+func (s *boltStorage) writeBatch(batch []storedMessage) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var (
+		added   []storedMessage
+		evicted int
+	)
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		var (
+			history = tx.Bucket(boltHistoryBucket)
+			order   = tx.Bucket(boltOrderBucket)
+		)
+		for _, entry := range batch {
+			addr := []byte(entry.Addr)
+			if b := history.Bucket(addr); b != nil && b.Get(entry.Message.TransactionID[:]) != nil {
+				continue
+			}
+			for s.count+len(added)-evicted >= s.capacity {
+				k, v := order.Cursor().First()
+				if k == nil {
+					break
+				}
+				if err := removeBoltEntry(tx, k, v); err != nil {
+					return err
+				}
+				evicted++
+			}
+			b, err := history.CreateBucketIfNotExists(addr)
+			if err != nil {
+				return err
+			}
+			id := entry.Message.TransactionID[:]
+			if err = b.Put(id, encodeBoltEntry(entry.CreatedAt, entry.Message)); err != nil {
+				return err
+			}
+			if err = order.Put(boltOrderKey(entry.CreatedAt, id), addr); err != nil {
+				return err
+			}
+			added = append(added, entry)
+		}
+		return nil
+	}); err != nil {
+		log.Println("storage: failed to add:", err)
+		return
+	}
+	if evicted > 0 {
+		storageStats.Add("eviction", int64(evicted))
+		log.Println("storage: evicted", evicted)
+	}
+	s.count += len(added) - evicted
+	storageStats.Add("size", int64(len(added)-evicted))
+	for _, entry := range added {
+		log.Println("storage: added", entry.Addr)
+		s.publish(entry)
+	}
+}
+
+// forEachBoltEntry calls f for every decodable message of addr in b.
+func forEachBoltEntry(addr []byte, b *bolt.Bucket, f func(storedMessage)) error {
+	return b.ForEach(func(k, v []byte) error {
+		entry, err := decodeBoltEntry(addr, v)
+		if err != nil {
+			log.Printf("storage: failed to decode %s entry %x: %s", addr, k, err)
+			return nil
+		}
+		f(entry)
+		return nil
+	})
+}
+
+func (s *boltStorage) lookup(addr string) []storedMessage {
+	var (
+		result  []storedMessage
+		timeout = s.now().Add(-s.ttl)
+	)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltHistoryBucket).Bucket([]byte(addr))
+		if b == nil {
+			return nil
+		}
+		return forEachBoltEntry([]byte(addr), b, func(entry storedMessage) {
+			if !entry.timedOut(timeout) {
+				result = append(result, entry)
+			}
+		})
+	}); err != nil {
+		log.Println("storage: failed to lookup:", err)
+	}
+	if len(result) == 0 {
+		storageStats.Add("miss", 1)
+	} else {
+		storageStats.Add("hit", 1)
+	}
+	sortMessages(result)
+	return result
+}
+
+func (s *boltStorage) list() []storedMessage {
+	var result []storedMessage
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(boltHistoryBucket)
+		return history.ForEach(func(addr, _ []byte) error {
+			b := history.Bucket(addr)
+			if b == nil {
+				return nil
+			}
+			return forEachBoltEntry(addr, b, func(entry storedMessage) {
+				result = append(result, entry)
+			})
+		})
+	}); err != nil {
+		log.Println("storage: failed to list:", err)
+	}
+	sortMessages(result)
+	return result
+}
+
+func (s *boltStorage) collect() {
+	timeout := boltOrderKey(s.now().Add(-s.ttl), nil)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	collected := 0
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		// Index is ordered by capture time, so expired messages are
+		// at the start.
+		c := tx.Bucket(boltOrderBucket).Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k, timeout) < 0; k, v = c.First() {
+			if err := removeBoltEntry(tx, k, v); err != nil {
+				return err
+			}
+			collected++
+		}
+		return nil
+	}); err != nil {
+		log.Println("storage: failed to collect:", err)
+		return
+	}
+	s.count -= collected
+	storageStats.Add("size", -int64(collected))
+	if collected > 0 {
+		log.Println("storage: collected", collected)
+	}
+}
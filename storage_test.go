@@ -0,0 +1,331 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testClock is manually advanced clock of storage.
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time { return c.t }
+
+type storageBackend struct {
+	name string
+	// open returns empty storage and function that makes added
+	// messages visible, returning storage to use after it.
+	open func(t *testing.T, ttl time.Duration, capacity int, clock *testClock) (storage, func() storage)
+}
+
+var storageBackends = []storageBackend{
+	{
+		name: "Memory",
+		open: func(t *testing.T, ttl time.Duration, capacity int, clock *testClock) (storage, func() storage) {
+			s := newMemoryStorage(ttl, capacity)
+			s.now = clock.now
+			return s, func() storage { return s }
+		},
+	},
+	{
+		name: "Bolt",
+		open: func(t *testing.T, ttl time.Duration, capacity int, clock *testClock) (storage, func() storage) {
+			path := filepath.Join(t.TempDir(), "storage.db")
+			open := func() *boltStorage {
+				s, err := newBoltStorage(path, ttl, capacity)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.now = clock.now
+				return s
+			}
+			s := open()
+			t.Cleanup(func() { s.Close() })
+			// Reopening database, because messages are written by
+			// background writer.
+			return s, func() storage {
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+				s = open()
+				return s
+			}
+		},
+	},
+}
+
+// storageStep advances clock and then adds message or collects storage.
+type storageStep struct {
+	advance time.Duration
+	addr    string
+	// msg is index of added message.
+	msg     int
+	collect bool
+}
+
+func TestStorage(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	const (
+		a = "192.0.2.1:3478"
+		b = "192.0.2.2:3478"
+	)
+	for _, tc := range []struct {
+		name     string
+		ttl      time.Duration
+		capacity int
+		steps    []storageStep
+		// lookup are indexes of messages returned by lookup of address.
+		lookup map[string][]int
+		// list are indexes of all stored messages.
+		list []int
+	}{
+		{
+			name:     "Lookup",
+			ttl:      time.Minute,
+			capacity: 100,
+			steps: []storageStep{
+				{addr: a, msg: 0},
+				{advance: time.Second, addr: b, msg: 1},
+				{advance: time.Second, addr: a, msg: 2},
+			},
+			lookup: map[string][]int{a: {0, 2}, b: {1}, "192.0.2.3:3478": nil},
+			list:   []int{0, 1, 2},
+		},
+		{
+			name:     "Retransmission",
+			ttl:      time.Minute,
+			capacity: 100,
+			steps: []storageStep{
+				{addr: a, msg: 0},
+				{advance: time.Second, addr: a, msg: 0},
+				{advance: time.Second, addr: a, msg: 1},
+			},
+			lookup: map[string][]int{a: {0, 1}},
+			list:   []int{0, 1},
+		},
+		{
+			name:     "Expired",
+			ttl:      time.Second * 10,
+			capacity: 100,
+			steps: []storageStep{
+				{addr: a, msg: 0},
+				{advance: time.Second * 6, addr: a, msg: 1},
+				{advance: time.Second * 5},
+			},
+			// Expired messages are hidden from lookup before collect.
+			lookup: map[string][]int{a: {1}},
+			list:   []int{0, 1},
+		},
+		{
+			name:     "Collect",
+			ttl:      time.Second * 10,
+			capacity: 100,
+			steps: []storageStep{
+				{addr: a, msg: 0},
+				{addr: b, msg: 1},
+				{advance: time.Second * 6, addr: a, msg: 2},
+				{advance: time.Second * 5, collect: true},
+			},
+			lookup: map[string][]int{a: {2}, b: nil},
+			list:   []int{2},
+		},
+		{
+			name:     "Capacity",
+			ttl:      time.Minute,
+			capacity: 1,
+			steps: []storageStep{
+				{addr: a, msg: 0},
+				{advance: time.Second, addr: b, msg: 1},
+				{advance: time.Second, addr: a, msg: 2},
+			},
+			lookup: map[string][]int{b: nil},
+			list:   []int{2},
+		},
+	} {
+		for _, backend := range storageBackends {
+			t.Run(tc.name+"/"+backend.name, func(t *testing.T) {
+				var (
+					clock   = &testClock{t: time.Unix(1500000000, 0)}
+					s, sync = backend.open(t, tc.ttl, tc.capacity, clock)
+					msgs    []*stun.Message
+					added   = make(map[int]time.Time)
+				)
+				for i := 0; i < 3; i++ {
+					msgs = append(msgs, stun.MustBuild(stun.TransactionID, stun.BindingRequest))
+				}
+				for _, step := range tc.steps {
+					clock.t = clock.t.Add(step.advance)
+					if step.collect {
+						s = sync()
+						s.collect()
+						continue
+					}
+					if len(step.addr) == 0 {
+						continue
+					}
+					s.add(step.addr, msgs[step.msg])
+					if _, ok := added[step.msg]; !ok {
+						added[step.msg] = clock.t
+					}
+				}
+				s = sync()
+				check := func(name string, got []storedMessage, want []int) {
+					t.Helper()
+					if len(got) != len(want) {
+						t.Fatalf("%s: got %d messages, want %d", name, len(got), len(want))
+					}
+					for i, idx := range want {
+						if got[i].Message.TransactionID != msgs[idx].TransactionID {
+							t.Errorf("%s: message %d is not %d", name, i, idx)
+						}
+						if !got[i].CreatedAt.Equal(added[idx]) {
+							t.Errorf("%s: message %d captured at %s, want %s", name, i, got[i].CreatedAt, added[idx])
+						}
+					}
+				}
+				for addr, want := range tc.lookup {
+					check("lookup "+addr, s.lookup(addr), want)
+				}
+				check("list", s.list(), tc.list)
+			})
+		}
+	}
+}
+
+func TestMemoryStorageLRU(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	var (
+		clock = &testClock{t: time.Unix(1500000000, 0)}
+		s     = newMemoryStorage(time.Second*10, storageShards*2)
+		a     = "192.0.2.1:3478"
+		b     string
+		msgs  []*stun.Message
+	)
+	s.now = clock.now
+	// Messages of a and b share shard of capacity 2.
+	for i := 2; s.shard(b) != s.shard(a); i++ {
+		b = "192.0.2." + strconv.Itoa(i) + ":3478"
+	}
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, stun.MustBuild(stun.TransactionID, stun.BindingRequest))
+	}
+	lookup := func(addr string) [][stun.TransactionIDSize]byte {
+		var ids [][stun.TransactionIDSize]byte
+		for _, entry := range s.lookup(addr) {
+			ids = append(ids, entry.Message.TransactionID)
+		}
+		return ids
+	}
+	s.add(a, msgs[0])
+	clock.t = clock.t.Add(time.Second)
+	s.add(b, msgs[1])
+	// Looking up a makes b least recently used.
+	lookup(a)
+	s.add(b, msgs[2])
+	if got := lookup(a); len(got) != 1 || got[0] != msgs[0].TransactionID {
+		t.Errorf("looked up message is evicted: %x", got)
+	}
+	if got := lookup(b); len(got) != 1 || got[0] != msgs[2].TransactionID {
+		t.Errorf("least recently used message is not evicted: %x", got)
+	}
+	// Message of a is expired while being most recently used.
+	lookup(a)
+	clock.t = clock.t.Add(time.Second * 10)
+	s.collect()
+	if got := lookup(a); len(got) != 0 {
+		t.Errorf("expired message is not collected: %x", got)
+	}
+	if got := lookup(b); len(got) != 1 {
+		t.Errorf("unexpired message is collected: %x", got)
+	}
+}
+
+func TestBoltStorageEviction(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	const capacity = 10
+	var (
+		path  = filepath.Join(t.TempDir(), "storage.db")
+		clock = &testClock{t: time.Unix(1500000000, 0)}
+		real  = "198.51.100.1:3478"
+	)
+	open := func() *boltStorage {
+		s, err := newBoltStorage(path, time.Minute, capacity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.now = clock.now
+		return s
+	}
+	add := func(s *boltStorage, addr string) *stun.Message {
+		m := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		clock.t = clock.t.Add(time.Millisecond)
+		s.add(addr, m)
+		return m
+	}
+	s := open()
+	// Flood from spoofed sources does not block new captures.
+	for i := 0; i < capacity*10; i++ {
+		add(s, "192.0.2."+strconv.Itoa(i)+":3478")
+	}
+	m := add(s, real)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = open()
+	if s.count != capacity {
+		t.Errorf("count is %d", s.count)
+	}
+	list := s.list()
+	if len(list) != capacity {
+		t.Fatalf("got %d messages", len(list))
+	}
+	if got := s.lookup(real); len(got) != 1 || got[0].Message.TransactionID != m.TransactionID {
+		t.Errorf("message from %s is not stored", real)
+	}
+	if list[0].Addr != "192.0.2."+strconv.Itoa(capacity*9+1)+":3478" {
+		t.Errorf("oldest message is from %s", list[0].Addr)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Index is re-created for database without it.
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(boltOrderBucket)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = open()
+	defer s.Close()
+	if s.count != capacity {
+		t.Errorf("count is %d after indexing", s.count)
+	}
+	// Older half of messages is expired.
+	clock.t = list[capacity/2].CreatedAt.Add(time.Minute)
+	s.collect()
+	if got := len(s.list()); got != capacity/2 {
+		t.Errorf("got %d messages after collect", got)
+	}
+	if got := s.lookup(real); len(got) != 1 {
+		t.Errorf("message from %s is collected", real)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/gortc/stun"
+)
+
+var (
+	software = stun.NewSoftware("gortc.io/x/sdp example")
+
+	bindingRequest = stun.MessageType{
+		Method: stun.MethodBinding,
+		Class:  stun.ClassRequest,
+	}
+	bindingSuccessResponse = stun.MessageType{
+		Method: stun.MethodBinding,
+		Class:  stun.ClassSuccessResponse,
+	}
+)
+
+// stunContext holds state of single STUN transaction.
+type stunContext struct {
+	req, res *stun.Message
+
+	local  net.Addr // address that received request
+	remote net.Addr // source address of request
+
+	// udp is set for requests received over UDP.
+	udp *udpServer
+	// ip and port are indexes of receiving socket in udp.
+	ip, port int
+	// change is CHANGE-REQUEST from request.
+	change changeRequest
+	// responsePort is RESPONSE-PORT from request, zero if not set.
+	responsePort int
+	// integrity is set if request was authenticated with short-term
+	// credentials, so response should be signed with it too.
+	integrity stun.MessageIntegrity
+	// fingerprint is true if request contains FINGERPRINT attribute.
+	fingerprint bool
+	// username is authenticated TURN username.
+	username string
+}
+
+func (ctx *stunContext) reset() {
+	ctx.req.Reset()
+	ctx.res.Reset()
+	ctx.change = changeRequest{}
+	ctx.responsePort = 0
+	ctx.integrity = nil
+	ctx.fingerprint = false
+	ctx.username = ""
+}
+
+// checkFingerprint verifies FINGERPRINT of request if it is present.
+func (ctx *stunContext) checkFingerprint() error {
+	if !ctx.req.Contains(stun.AttrFingerprint) {
+		return nil
+	}
+	if err := stun.Fingerprint.Check(ctx.req); err != nil {
+		return err
+	}
+	ctx.fingerprint = true
+	return nil
+}
+
+// checkIntegrity verifies MESSAGE-INTEGRITY of request if it is present
+// and username is known.
+func (ctx *stunContext) checkIntegrity() error {
+	req := ctx.req
+	if !req.Contains(stun.AttrMessageIntegrity) {
+		return nil
+	}
+	var username stun.Username
+	if err := username.GetFrom(req); err != nil {
+		return err
+	}
+	password, ok := credentials.password(username.String())
+	if !ok && lite != nil {
+		// Connectivity check of ICE-lite session.
+		password, ok = lite.password(username.String())
+	}
+	if !ok {
+		log.Printf("stun: unknown username %q from %s", username, ctx.remote)
+		return nil
+	}
+	integrity := stun.NewShortTermIntegrity(password)
+	if err := integrity.Check(req); err != nil {
+		return err
+	}
+	ctx.integrity = integrity
+	return nil
+}
+
+// turn returns TURN server that should process request, if any.
+func (ctx *stunContext) turn() *turnServer {
+	if ctx.udp == nil {
+		return nil
+	}
+	return ctx.udp.turn
+}
+
+// understood reports whether comprehension-required attribute is
+// supported for request. PADDING of RFC 5780 is not understood,
+// because it is never applied to responses.
+func (ctx *stunContext) understood(t stun.AttrType) bool {
+	switch t {
+	case stun.AttrUsername, stun.AttrMessageIntegrity,
+		stun.AttrPriority, stun.AttrUseCandidate:
+		return true
+	case attrChangeRequest, attrResponsePort:
+		return ctx.udp != nil && ctx.udp.behavior
+	case stun.AttrRealm, stun.AttrNonce, stun.AttrLifetime,
+		stun.AttrRequestedTransport, stun.AttrXORPeerAddress,
+		stun.AttrChannelNumber, stun.AttrData:
+		return ctx.turn() != nil && ctx.req.Type.Method != stun.MethodBinding
+	default:
+		return false
+	}
+}
+
+// unknownAttributes returns list of comprehension-required attributes
+// from request that are not understood.
+func (ctx *stunContext) unknownAttributes() stun.UnknownAttributes {
+	var unknown stun.UnknownAttributes
+	for _, a := range ctx.req.Attributes {
+		if a.Type >= 0x8000 || ctx.understood(a.Type) {
+			continue
+		}
+		unknown = append(unknown, a.Type)
+	}
+	return unknown
+}
+
+// buildError builds error response with provided code and attributes.
+func (ctx *stunContext) buildError(code stun.ErrorCode, setters ...stun.Setter) error {
+	log.Printf("stun: responding %d to %s from %s", code, ctx.req.Type, ctx.remote)
+	res := ctx.res
+	res.Reset()
+	res.Type = stun.MessageType{
+		Method: ctx.req.Type.Method,
+		Class:  stun.ClassErrorResponse,
+	}
+	res.TransactionID = ctx.req.TransactionID
+	res.WriteHeader()
+	if err := code.AddTo(res); err != nil {
+		return err
+	}
+	for _, s := range setters {
+		if err := s.AddTo(res); err != nil {
+			return err
+		}
+	}
+	if err := software.AddTo(res); err != nil {
+		return err
+	}
+	return ctx.sign()
+}
+
+// sign adds MESSAGE-INTEGRITY and FINGERPRINT to response if
+// request had them.
+func (ctx *stunContext) sign() error {
+	if ctx.integrity != nil {
+		if err := ctx.integrity.AddTo(ctx.res); err != nil {
+			return err
+		}
+	}
+	if ctx.fingerprint {
+		return stun.Fingerprint.AddTo(ctx.res)
+	}
+	return nil
+}
+
+var (
+	errNotSTUNMessage = errors.New("not STUN message")
+	errNotRequest     = errors.New("not request")
+)
+
+// processUDPPacket processes STUN message from b, building success or
+// error response in ctx.res. Returned error means that request should
+// be dropped without response.
+func processUDPPacket(ctx *stunContext, b []byte) error {
+	req, res := ctx.req, ctx.res
+	if !stun.IsMessage(b) {
+		if *classicSTUN && ctx.udp != nil && isClassicRequest(b) {
+			return processClassic(ctx, b)
+		}
+		return errNotSTUNMessage
+	}
+	req.Raw = b
+	if err := req.Decode(); err != nil {
+		// Header is valid because it was checked by IsMessage.
+		req.Type.ReadValue(binary.BigEndian.Uint16(b[0:2]))
+		copy(req.TransactionID[:], b[8:stunHeaderSize])
+		if req.Type.Class != stun.ClassRequest {
+			return err
+		}
+		log.Println("stun: failed to decode request from", ctx.remote, ":", err)
+		return ctx.buildError(stun.CodeBadRequest)
+	}
+	if req.Type.Class != stun.ClassRequest {
+		return errNotRequest
+	}
+	log.Println("stun: got", req.Type, "from", ctx.remote)
+	clientStats.Add("modern", 1)
+	if err := ctx.checkFingerprint(); err != nil {
+		return err
+	}
+	if req.Type.Method != stun.MethodBinding && ctx.turn() != nil {
+		return ctx.turn().process(ctx)
+	}
+	// Unsupported methods are rejected before checking attributes, so
+	// attributes of other methods are not reported as unknown.
+	if req.Type != bindingRequest {
+		return ctx.buildError(stun.CodeBadRequest)
+	}
+	if err := ctx.checkIntegrity(); err != nil {
+		log.Println("stun: failed to check integrity:", err)
+		if err == stun.ErrAttributeNotFound {
+			return ctx.buildError(stun.CodeBadRequest)
+		}
+		return ctx.buildError(stun.CodeUnauthorised)
+	}
+	if unknown := ctx.unknownAttributes(); len(unknown) > 0 {
+		return ctx.buildError(stun.CodeUnknownAttribute, unknown)
+	}
+	res.TransactionID = req.TransactionID
+	res.Type = bindingSuccessResponse
+	var (
+		ip   net.IP
+		port int
+	)
+	switch a := ctx.remote.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+		port = a.Port
+	case *net.TCPAddr:
+		ip = a.IP
+		port = a.Port
+	default:
+		panic(fmt.Sprintf("unknown addr: %v", ctx.remote))
+	}
+	stun.XORMappedAddress{
+		IP:   ip,
+		Port: port,
+	}.AddTo(res)
+	if ctx.udp != nil {
+		if err := ctx.udp.processBehavior(ctx); err != nil {
+			log.Println("stun: failed to process behavior attributes:", err)
+			return ctx.buildError(stun.CodeBadRequest)
+		}
+	}
+	software.AddTo(res)
+	res.WriteHeader()
+	if err := ctx.sign(); err != nil {
+		return err
+	}
+	if lite != nil && ctx.integrity != nil && ctx.udp != nil {
+		lite.check(ctx)
+	}
+	messages.add(net.JoinHostPort(ip.String(), strconv.Itoa(port)), req)
+	return nil
+}
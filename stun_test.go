@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/gortc/stun"
+)
+
+// processRequest processes request received by server over UDP and
+// returns response, nil if there is no response.
+func processRequest(t *testing.T, s *udpServer, req *stun.Message) *stun.Message {
+	t.Helper()
+	ctx := &stunContext{
+		req:    new(stun.Message),
+		res:    new(stun.Message),
+		local:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478},
+		remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000},
+		udp:    s,
+	}
+	if err := processUDPPacket(ctx, append([]byte(nil), req.Raw...)); err != nil {
+		return nil
+	}
+	res := &stun.Message{Raw: ctx.res.Raw}
+	if err := res.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// errorCode returns error code of response, zero for success.
+func errorCode(t *testing.T, res *stun.Message) stun.ErrorCode {
+	t.Helper()
+	if res.Type.Class == stun.ClassSuccessResponse {
+		return 0
+	}
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	return code.Code
+}
+
+func TestBehaviorAttributesUnderstood(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	padding := stun.RawAttribute{Type: attrPadding, Value: make([]byte, 8)}
+	for _, tc := range []struct {
+		name     string
+		behavior bool
+		attr     stun.Setter
+		unknown  stun.AttrType
+	}{
+		{"ChangeRequest", true, changeRequest{Port: true}, 0},
+		{"ResponsePort", true, responsePort(5001), 0},
+		{"Padding", true, rawAttr(padding), attrPadding},
+		{"ChangeRequestDisabled", false, changeRequest{Port: true}, attrChangeRequest},
+		{"ResponsePortDisabled", false, responsePort(5001), attrResponsePort},
+		{"PaddingDisabled", false, rawAttr(padding), attrPadding},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &udpServer{behavior: tc.behavior}
+			if tc.behavior {
+				for i := range s.addrs {
+					for j := range s.addrs[i] {
+						s.addrs[i][j] = &net.UDPAddr{IP: net.IPv4(127, 0, 0, byte(i+1)), Port: 3478 + j}
+					}
+				}
+			}
+			res := processRequest(t, s, stun.MustBuild(stun.TransactionID, stun.BindingRequest, tc.attr))
+			if res == nil {
+				t.Fatal("no response")
+			}
+			if tc.unknown == 0 {
+				if code := errorCode(t, res); code != 0 {
+					t.Errorf("unexpected error %d", code)
+				}
+				return
+			}
+			if code := errorCode(t, res); code != stun.CodeUnknownAttribute {
+				t.Fatalf("unexpected code %d", code)
+			}
+			var unknown stun.UnknownAttributes
+			if err := unknown.GetFrom(res); err != nil {
+				t.Fatal(err)
+			}
+			if len(unknown) != 1 || unknown[0] != tc.unknown {
+				t.Errorf("unexpected unknown attributes %s", unknown)
+			}
+		})
+	}
+}
+
+// rawAttr is attribute that is added to message as is.
+type rawAttr stun.RawAttribute
+
+func (a rawAttr) AddTo(m *stun.Message) error {
+	m.Add(a.Type, a.Value)
+	return nil
+}
+
+func TestProcessUDPPacketErrors(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	unknown := rawAttr{Type: 0x0030, Value: make([]byte, 4)}
+	for _, tc := range []struct {
+		name    string
+		msg     *stun.Message
+		code    stun.ErrorCode
+		unknown stun.UnknownAttributes
+		// noReply is true if message should be dropped.
+		noReply bool
+	}{
+		{
+			name: "Binding",
+			msg:  stun.MustBuild(stun.TransactionID, stun.BindingRequest),
+		},
+		{
+			name:    "UnknownAttribute",
+			msg:     stun.MustBuild(stun.TransactionID, stun.BindingRequest, unknown),
+			code:    stun.CodeUnknownAttribute,
+			unknown: stun.UnknownAttributes{0x0030},
+		},
+		{
+			name: "UnknownOptionalAttribute",
+			msg: stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+				rawAttr{Type: 0x8030, Value: make([]byte, 4)},
+			),
+		},
+		{
+			// TURN attributes are not reported as unknown if TURN is
+			// disabled, because method is not supported at all.
+			name: "Allocate",
+			msg: stun.MustBuild(stun.TransactionID,
+				stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+				requestedTransport(protoUDP), lifetime(turnDefaultLifetime),
+			),
+			code: stun.CodeBadRequest,
+		},
+		{
+			name: "UnsupportedMethodUnknownAttribute",
+			msg: stun.MustBuild(stun.TransactionID,
+				stun.NewType(stun.MethodRefresh, stun.ClassRequest), unknown,
+			),
+			code: stun.CodeBadRequest,
+		},
+		{
+			name:    "Indication",
+			msg:     stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodBinding, stun.ClassIndication)),
+			noReply: true,
+		},
+		{
+			name:    "SuccessResponse",
+			msg:     stun.MustBuild(stun.TransactionID, bindingSuccessResponse),
+			noReply: true,
+		},
+		{
+			name: "ErrorResponse",
+			msg: stun.MustBuild(stun.TransactionID,
+				stun.NewType(stun.MethodBinding, stun.ClassErrorResponse), stun.CodeBadRequest,
+			),
+			noReply: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res := processRequest(t, &udpServer{}, tc.msg)
+			if tc.noReply {
+				if res != nil {
+					t.Fatalf("unexpected response %s", res)
+				}
+				return
+			}
+			if res == nil {
+				t.Fatal("no response")
+			}
+			if res.TransactionID != tc.msg.TransactionID || res.Type.Method != tc.msg.Type.Method {
+				t.Errorf("unexpected response %s", res)
+			}
+			if code := errorCode(t, res); code != tc.code {
+				t.Fatalf("got code %d, want %d", code, tc.code)
+			}
+			if tc.unknown == nil {
+				if res.Contains(stun.AttrUnknownAttributes) {
+					t.Error("unexpected UNKNOWN-ATTRIBUTES")
+				}
+				return
+			}
+			var unknown stun.UnknownAttributes
+			if err := unknown.GetFrom(res); err != nil {
+				t.Fatal(err)
+			}
+			if unknown.String() != tc.unknown.String() {
+				t.Errorf("got unknown attributes %s, want %s", unknown, tc.unknown)
+			}
+		})
+	}
+}
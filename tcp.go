@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+const stunHeaderSize = 20
+
+// tcpIdleTimeout is maximum time of waiting for next message on
+// connection before closing it.
+var tcpIdleTimeout = time.Second * 30
+
+// readTCPMessage reads single STUN message from stream into buf,
+// growing it if needed. STUN messages over TCP are not framed
+// explicitly, so message length from header is used to find the
+// message boundary, as described in RFC 5389 Section 7.2.2.
+func readTCPMessage(r io.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:stunHeaderSize]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return buf, err
+	}
+	if !stun.IsMessage(buf) {
+		return buf, errNotSTUNMessage
+	}
+	size := stunHeaderSize + int(binary.BigEndian.Uint16(buf[2:4]))
+	if cap(buf) < size {
+		b := make([]byte, size)
+		copy(b, buf)
+		buf = b
+	}
+	buf = buf[:size]
+	_, err := io.ReadFull(r, buf[stunHeaderSize:])
+	return buf, err
+}
+
+func serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	var (
+		addr = conn.RemoteAddr()
+		ctx  = &stunContext{
+			req:    new(stun.Message),
+			res:    new(stun.Message),
+			local:  conn.LocalAddr(),
+			remote: addr,
+		}
+		buf = make([]byte, 1024)
+	)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout)); err != nil {
+			log.Println("tcp: failed to set deadline:", err)
+			return
+		}
+		b, err := readTCPMessage(conn, buf)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("tcp: failed to read message from", addr, ":", err)
+			}
+			return
+		}
+		buf = b[:cap(b)]
+		if !limiter.allow(addr.(*net.TCPAddr).IP) {
+			continue
+		}
+		log.Printf("tcp: got message len(%d) from %s", len(b), addr)
+		if err = processUDPPacket(ctx, b); err != nil {
+			log.Println("failed to process TCP message:", err, "from addr", addr)
+			ctx.reset()
+			continue
+		}
+		log.Printf("stun: parsed message %q from %s", ctx.req, addr)
+		if _, err = conn.Write(ctx.res.Raw); err != nil {
+			log.Println("failed to send message:", err)
+			return
+		}
+		ctx.reset()
+	}
+}
+
+// serveTCP accepts STUN over TCP connections from l.
+func serveTCP(l net.Listener) {
+	log.Println("Started STUN server on", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("l.Accept:", err)
+				time.Sleep(time.Millisecond * 100)
+				continue
+			}
+			log.Fatalln("l.Accept:", err)
+		}
+		go serveTCPConn(conn)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestReadTCPMessage(t *testing.T) {
+	var (
+		first  = stun.MustBuild(stun.TransactionID, stun.BindingRequest, software, stun.Fingerprint)
+		second = stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		stream = append(append([]byte(nil), first.Raw...), second.Raw...)
+	)
+	for _, tc := range []struct {
+		name string
+		r    io.Reader
+	}{
+		{"BackToBack", bytes.NewReader(stream)},
+		// Every read returns single byte, so header is split.
+		{"SplitHeader", iotest.OneByteReader(bytes.NewReader(stream))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Buffer is smaller than first message to check growing.
+			buf := make([]byte, stunHeaderSize)
+			for _, want := range []*stun.Message{first, second} {
+				b, err := readTCPMessage(tc.r, buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, want.Raw) {
+					t.Fatalf("got %x, want %x", b, want.Raw)
+				}
+				buf = b[:cap(b)]
+			}
+			if _, err := readTCPMessage(tc.r, buf); err != io.EOF {
+				t.Errorf("unexpected error %v after last message", err)
+			}
+		})
+	}
+	t.Run("OversizedLength", func(t *testing.T) {
+		// Length field claims more data than is in stream.
+		b := append([]byte(nil), first.Raw...)
+		binary.BigEndian.PutUint16(b[2:4], 0xFFFC)
+		got, err := readTCPMessage(bytes.NewReader(b), make([]byte, 1024))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("unexpected error %v", err)
+		}
+		if len(got) != stunHeaderSize+0xFFFC {
+			t.Errorf("buffer length %d", len(got))
+		}
+	})
+	t.Run("NotSTUN", func(t *testing.T) {
+		b := append([]byte(nil), first.Raw...)
+		b[4] = 0 // magic cookie
+		if _, err := readTCPMessage(bytes.NewReader(b), make([]byte, stunHeaderSize)); err != errNotSTUNMessage {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestServeTCPConn(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(timeout time.Duration) { tcpIdleTimeout = timeout }(tcpIdleTimeout)
+	tcpIdleTimeout = time.Millisecond * 100
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverConn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		serveTCPConn(serverConn)
+		close(done)
+	}()
+	// Restoring timeout after connection is served.
+	defer func() { <-done }()
+	var (
+		reqs = []*stun.Message{
+			stun.MustBuild(stun.TransactionID, stun.BindingRequest),
+			stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint),
+		}
+		stream []byte
+	)
+	for _, req := range reqs {
+		stream = append(stream, req.Raw...)
+	}
+	// Both requests are sent in single write.
+	if _, err = conn.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	for _, req := range reqs {
+		if err = conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		b, err := readTCPMessage(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := &stun.Message{Raw: b}
+		if err = res.Decode(); err != nil {
+			t.Fatal(err)
+		}
+		if res.Type != bindingSuccessResponse || res.TransactionID != req.TransactionID {
+			t.Errorf("unexpected response %s", res)
+		}
+		var addr stun.XORMappedAddress
+		if err = addr.GetFrom(res); err != nil {
+			t.Error(err)
+		} else if addr.Port != conn.LocalAddr().(*net.TCPAddr).Port {
+			t.Errorf("unexpected mapped address %s", addr)
+		}
+	}
+	// Idle connection is closed by server.
+	start := time.Now()
+	if err = conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(buf); err != io.EOF {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d := time.Since(start); d < tcpIdleTimeout/2 {
+		t.Errorf("closed after %s", d)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certLoader loads TLS certificate from files and reloads it when
+// any of files is changed on disk, e.g. by lego renewal.
+type certLoader struct {
+	certFile string
+	keyFile  string
+
+	mux     sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := &certLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// lastModified returns latest modification time of certificate files.
+func (l *certLoader) lastModified() (time.Time, error) {
+	var t time.Time
+	for _, name := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return t, err
+		}
+		if info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (l *certLoader) load() error {
+	modTime, err := l.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.mux.Lock()
+	l.cert = &cert
+	l.modTime = modTime
+	l.mux.Unlock()
+	return nil
+}
+
+// reload loads certificate again if files were changed since last load.
+func (l *certLoader) reload() error {
+	modTime, err := l.lastModified()
+	if err != nil {
+		return err
+	}
+	l.mux.RLock()
+	changed := modTime.After(l.modTime)
+	l.mux.RUnlock()
+	if !changed {
+		return nil
+	}
+	if err = l.load(); err != nil {
+		return err
+	}
+	log.Println("tls: reloaded certificate from", l.certFile)
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+	return l.cert, nil
+}
+
+func (l *certLoader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if err := l.reload(); err != nil {
+			log.Println("tls: failed to reload certificate:", err)
+		}
+	}
+}
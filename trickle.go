@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gortc/sdp"
+)
+
+const (
+	// trickleSessionLifetime is how long trickle session is kept.
+	trickleSessionLifetime = time.Minute * 10
+	// trickleMaxSessions limits total number of trickle sessions, oldest
+	// one is evicted by new offer.
+	trickleMaxSessions = 1000
+	// trickleMaxEvents limits number of events and recorded STUN
+	// transactions in single session.
+	trickleMaxEvents = 500
+	// trickleMaxReflexive limits number of server reflexive candidates
+	// in single session that are looked up in storage by timeline.
+	trickleMaxReflexive = 20
+)
+
+// Kinds of trickle session events.
+const (
+	eventOffer           = "offer"
+	eventCandidate       = "candidate"
+	eventSTUN            = "stun"
+	eventEndOfCandidates = "end-of-candidates"
+)
+
+// trickleEvent is single entry of trickle session timeline.
+type trickleEvent struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Value is SDP of offer or candidate line.
+	Value     string           `json:"value,omitempty"`
+	Candidate *candidateReport `json:"candidate,omitempty"`
+	Message   *messageReport   `json:"message,omitempty"`
+}
+
+// trickleSession correlates offer and trickled candidates posted to
+// /x/sdp by single client with captured STUN transactions.
+type trickleSession struct {
+	ID      string         `json:"id"`
+	Created time.Time      `json:"created"`
+	Events  []trickleEvent `json:"events"`
+	// Ended is true if end-of-candidates was received.
+	Ended bool `json:"ended"`
+
+	// transactions are recorded STUN transactions, hex encoded.
+	transactions map[string]bool
+	// reflexive are addresses of server reflexive candidates.
+	reflexive []string
+}
+
+// trickleSessions stores trickle sessions by ID.
+type trickleSessions struct {
+	mux      sync.Mutex
+	sessions map[string]*trickleSession
+}
+
+var trickle = &trickleSessions{
+	sessions: make(map[string]*trickleSession),
+}
+
+func newTrickleSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// create returns new empty session, evicting oldest one if there are
+// too many sessions.
+func (t *trickleSessions) create() (*trickleSession, error) {
+	id, err := newTrickleSessionID()
+	if err != nil {
+		return nil, err
+	}
+	s := &trickleSession{
+		ID:           id,
+		Created:      time.Now(),
+		transactions: make(map[string]bool),
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if len(t.sessions) >= trickleMaxSessions {
+		t.evictOldest()
+	}
+	t.sessions[id] = s
+	return s, nil
+}
+
+// evictOldest removes session that was created first, t.mux must be
+// held.
+func (t *trickleSessions) evictOldest() {
+	var oldest *trickleSession
+	for _, s := range t.sessions {
+		if oldest == nil || s.Created.Before(oldest.Created) {
+			oldest = s
+		}
+	}
+	if oldest != nil {
+		delete(t.sessions, oldest.ID)
+		log.Println("trickle: evicted session", oldest.ID)
+	}
+}
+
+// exists reports whether session with id exists.
+func (t *trickleSessions) exists(id string) bool {
+	t.mux.Lock()
+	_, ok := t.sessions[id]
+	t.mux.Unlock()
+	return ok
+}
+
+func (s *trickleSession) addEvent(e trickleEvent) {
+	if len(s.Events) >= trickleMaxEvents {
+		return
+	}
+	s.Events = append(s.Events, e)
+}
+
+func (s *trickleSession) addMessage(m messageReport) {
+	if s.transactions[m.TransactionID] || len(s.transactions) >= trickleMaxEvents {
+		return
+	}
+	s.transactions[m.TransactionID] = true
+	s.addEvent(trickleEvent{Time: m.Time, Kind: eventSTUN, Message: &m})
+}
+
+func (s *trickleSession) addReflexive(addr string) {
+	if len(s.reflexive) >= trickleMaxReflexive {
+		return
+	}
+	for _, a := range s.reflexive {
+		if a == addr {
+			return
+		}
+	}
+	s.reflexive = append(s.reflexive, addr)
+}
+
+// record adds body posted to /x/sdp and its report to session with id.
+func (t *trickleSessions) record(id string, body string, report sdpReport) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	s, ok := t.sessions[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if report.isOffer() {
+		s.addEvent(trickleEvent{Time: now, Kind: eventOffer, Value: body})
+	}
+	for _, line := range report.Lines {
+		if line.Key == "a" && line.Value == eventEndOfCandidates {
+			s.Ended = true
+			s.addEvent(trickleEvent{Time: now, Kind: eventEndOfCandidates})
+			continue
+		}
+		if line.Candidate == nil {
+			continue
+		}
+		s.addEvent(trickleEvent{
+			Time:      now,
+			Kind:      eventCandidate,
+			Value:     line.Value,
+			Candidate: line.Candidate,
+		})
+		if line.Candidate.Reflexive {
+			s.addReflexive(net.JoinHostPort(
+				line.Candidate.Address, strconv.Itoa(line.Candidate.Port),
+			))
+		}
+		for _, m := range line.Candidate.Messages {
+			s.addMessage(m)
+		}
+	}
+}
+
+// reportSDP analyzes SDP posted by client to /x/sdp or signaling
+// channel and records it to trickle session with id. Offer without id
+// starts new session, report is still returned without session if it
+// can't be created. STUN messages of report are written to packet log
+// with browser from userAgent.
+func reportSDP(s sdp.Session, body, id, userAgent string) sdpReport {
+	report := analyzeSDP(s, messages, mdns)
+	report.SessionID = id
+	if report.SessionID == "" && report.isOffer() {
+		if session, err := trickle.create(); err != nil {
+			log.Println("trickle: failed to create session:", err)
+		} else {
+			report.SessionID = session.ID
+		}
+	}
+	if report.SessionID != "" {
+		trickle.record(report.SessionID, body, report)
+	}
+	if err := packets.write(report, userAgent); err != nil {
+		log.Fatalln("log: failed to write:", err)
+	}
+	return report
+}
+
+// recordMessage adds STUN transaction to session with id.
+func (t *trickleSessions) recordMessage(id string, m messageReport) {
+	t.mux.Lock()
+	if s, ok := t.sessions[id]; ok {
+		s.addMessage(m)
+	}
+	t.mux.Unlock()
+}
+
+// timeline returns copy of session with id and events ordered by time,
+// including STUN transactions of server reflexive candidates that were
+// captured after candidate was posted. Returns nil if not found.
+func (t *trickleSessions) timeline(id string, store storage) *trickleSession {
+	t.mux.Lock()
+	s, ok := t.sessions[id]
+	if !ok {
+		t.mux.Unlock()
+		return nil
+	}
+	reflexive := append([]string(nil), s.reflexive...)
+	t.mux.Unlock()
+	// Storage is not accessed under lock, so lookups don't block other
+	// sessions.
+	var captured []storedMessage
+	for _, addr := range reflexive {
+		captured = append(captured, store.lookup(addr)...)
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, entry := range captured {
+		s.addMessage(newMessageReport(entry))
+	}
+	c := *s
+	c.Events = make([]trickleEvent, len(s.Events))
+	copy(c.Events, s.Events)
+	sort.SliceStable(c.Events, func(i, j int) bool {
+		return c.Events[i].Time.Before(c.Events[j].Time)
+	})
+	return &c
+}
+
+func (t *trickleSessions) collect() {
+	timeout := time.Now().Add(-trickleSessionLifetime)
+	t.mux.Lock()
+	collected := 0
+	for id, s := range t.sessions {
+		if s.Created.Before(timeout) {
+			delete(t.sessions, id)
+			collected++
+		}
+	}
+	t.mux.Unlock()
+	if collected > 0 {
+		log.Println("trickle: collected", collected, "sessions")
+	}
+}
+
+func (t *trickleSessions) gc() {
+	ticker := time.NewTicker(time.Second * 5)
+	for range ticker.C {
+		t.collect()
+	}
+}
+
+// trickleSessionTemplate renders timeline of trickle session as page.
+var trickleSessionTemplate = template.Must(template.New("session").Funcs(template.FuncMap{
+	"clock": func(t time.Time) string {
+		return t.Format("15:04:05.000")
+	},
+	"hostPort": func(host string, port int) string {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	},
+}).Parse(`<!doctype html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>SDP session {{ .ID }}</title>
+    <link rel="stylesheet" href="/css/main.css">
+</head>
+<body>
+<div class="container">
+    <h1>SDP session</h1>
+    <a href="/x/sdp/" class="link-back">back to SDP example</a>
+    <p>session <code>{{ .ID }}</code> created at {{ clock .Created }}
+    {{- if .Ended }}, all candidates received{{ else }}, waiting for end-of-candidates{{ end }}</p>
+{{- range .Events }}
+    <div class="stun-transaction">
+    <p>{{ clock .Time }} {{ .Kind }}</p>
+{{- if eq .Kind "offer" }}
+    <pre>{{ .Value }}</pre>
+{{- end }}
+{{- with .Candidate }}
+    <p>{{ .Type }} {{ .Transport }} {{ hostPort .Address .Port }} priority={{ .Priority }}{{ if .MDNS }} (mDNS){{ end }}</p>
+{{- end }}
+{{- with .Message }}
+    <p>{{ .Type }} from {{ .Addr }}, transaction {{ .TransactionID }}</p>
+{{- end }}
+    </div>
+{{- end }}
+</div>
+</body>
+</html>
+`))
+
+// writeHTML renders timeline of session as HTML page.
+func (s *trickleSession) writeHTML(w io.Writer) error {
+	return trickleSessionTemplate.Execute(w, s)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTrickleSessionsEviction(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	sessions := &trickleSessions{sessions: make(map[string]*trickleSession)}
+	first, err := sessions.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Created = first.Created.Add(-time.Minute)
+	for i := 1; i < trickleMaxSessions; i++ {
+		if _, err = sessions.create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last, err := sessions.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions.sessions) != trickleMaxSessions {
+		t.Errorf("sessions: %d, expected %d", len(sessions.sessions), trickleMaxSessions)
+	}
+	if sessions.exists(first.ID) {
+		t.Error("oldest session is not evicted")
+	}
+	if !sessions.exists(last.ID) {
+		t.Error("new session is not created")
+	}
+}
+
+func TestTrickleSessionLimits(t *testing.T) {
+	sessions := &trickleSessions{sessions: make(map[string]*trickleSession)}
+	session, err := sessions.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report sdpReport
+	for i := 0; i < trickleMaxEvents*2; i++ {
+		report.Lines = append(report.Lines, lineReport{
+			Key: "a", Value: "candidate",
+			Candidate: &candidateReport{
+				Address:   "192.0.2.1",
+				Port:      1000 + i,
+				Reflexive: true,
+				Messages: []messageReport{
+					{TransactionID: fmt.Sprintf("%024x", i)},
+				},
+			},
+		})
+	}
+	sessions.record(session.ID, "", report)
+	for i := 0; i < trickleMaxEvents; i++ {
+		sessions.recordMessage(session.ID, messageReport{
+			TransactionID: fmt.Sprintf("%024x", trickleMaxEvents*2+i),
+		})
+	}
+	if n := len(session.reflexive); n != trickleMaxReflexive {
+		t.Errorf("reflexive: %d, expected %d", n, trickleMaxReflexive)
+	}
+	if n := len(session.transactions); n != trickleMaxEvents {
+		t.Errorf("transactions: %d, expected %d", n, trickleMaxEvents)
+	}
+	if n := len(session.Events); n != trickleMaxEvents {
+		t.Errorf("events: %d, expected %d", n, trickleMaxEvents)
+	}
+}
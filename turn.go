@@ -0,0 +1,739 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+// Lifetimes of TURN allocations, permissions and channels.
+//
+// RFC 5766 Sections 2.2, 8 and 11
+const (
+	turnDefaultLifetime    = time.Minute * 10
+	turnMaxLifetime        = time.Hour
+	turnPermissionLifetime = time.Minute * 5
+	turnChannelLifetime    = time.Minute * 10
+	turnNonceLifetime      = time.Hour
+)
+
+// Range of valid channel numbers, RFC 5766 Section 11.
+const (
+	turnMinChannel = 0x4000
+	turnMaxChannel = 0x7FFF
+)
+
+// turnMaxAllocations limits total number of allocations.
+const turnMaxAllocations = 1000
+
+const channelDataHeaderSize = 4
+
+// turnDeniedPeers are ranges of peer addresses that relay is not
+// allowed to reach, so TURN can't be used to access services of server
+// host and its private networks, like denied-peer-ip of coturn.
+var turnDeniedPeers = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"127.0.0.0/8",    // loopback
+	"10.0.0.0/8",     // RFC 1918
+	"172.16.0.0/12",  // RFC 1918
+	"192.168.0.0/16", // RFC 1918
+	"169.254.0.0/16", // link-local
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fe80::/10",      // link-local
+	"fc00::/7",       // unique local
+)
+
+// parseCIDRs parses comma-separated list of CIDR ranges.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(ranges ...string) []*net.IPNet {
+	nets, err := parseCIDRs(strings.Join(ranges, ","))
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	turnStats = expvar.NewMap("turn")
+
+	dataIndication = stun.NewType(stun.MethodData, stun.ClassIndication)
+	sendIndication = stun.NewType(stun.MethodSend, stun.ClassIndication)
+)
+
+type turnChannel struct {
+	number  uint16
+	peer    *net.UDPAddr
+	expires time.Time
+}
+
+// allocation is TURN allocation that relays data between client and
+// peers via relay socket.
+type allocation struct {
+	key      string
+	client   *net.UDPAddr
+	conn     net.PacketConn // server socket that is used to reach client
+	relay    *net.UDPConn
+	username string
+
+	mux         sync.Mutex
+	expires     time.Time
+	permissions map[string]time.Time    // peer IP -> expiration
+	channels    map[uint16]*turnChannel // number -> channel
+	peers       map[string]*turnChannel // peer address -> channel
+}
+
+func (a *allocation) permitted(ip net.IP, now time.Time) bool {
+	return a.permissions[ip.String()].After(now)
+}
+
+// serveRelay relays data from peers to client until relay socket is
+// closed.
+func (a *allocation) serveRelay() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := a.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		peer := addr.(*net.UDPAddr)
+		a.mux.Lock()
+		var (
+			allowed = a.permitted(peer.IP, time.Now())
+			ch      = a.peers[peer.String()]
+		)
+		a.mux.Unlock()
+		if !allowed {
+			continue
+		}
+		var b []byte
+		if ch != nil {
+			b = make([]byte, channelDataHeaderSize+n)
+			binary.BigEndian.PutUint16(b[0:2], ch.number)
+			binary.BigEndian.PutUint16(b[2:4], uint16(n))
+			copy(b[channelDataHeaderSize:], buf[:n])
+		} else {
+			m, err := stun.Build(stun.TransactionID, dataIndication,
+				xorAddr{Type: stun.AttrXORPeerAddress, IP: peer.IP, Port: peer.Port},
+				rawData(buf[:n]),
+			)
+			if err != nil {
+				log.Println("turn: failed to build data indication:", err)
+				continue
+			}
+			b = m.Raw
+		}
+		if _, err = a.conn.WriteTo(b, a.client); err != nil {
+			log.Println("turn: failed to send data to", a.client, ":", err)
+		}
+	}
+}
+
+// sendTo relays data from client to peer if permission is installed.
+func (a *allocation) sendTo(peer *net.UDPAddr, data []byte) {
+	a.mux.Lock()
+	allowed := a.permitted(peer.IP, time.Now())
+	a.mux.Unlock()
+	if !allowed {
+		return
+	}
+	if _, err := a.relay.WriteTo(data, peer); err != nil {
+		log.Println("turn: failed to send data to peer", peer, ":", err)
+	}
+}
+
+// sendToChannel relays data from client to peer bound to channel.
+func (a *allocation) sendToChannel(number uint16, data []byte) {
+	a.mux.Lock()
+	ch := a.channels[number]
+	a.mux.Unlock()
+	if ch == nil {
+		return
+	}
+	a.sendTo(ch.peer, data)
+}
+
+func (a *allocation) collect(now time.Time) {
+	a.mux.Lock()
+	for ip, expires := range a.permissions {
+		if expires.Before(now) {
+			delete(a.permissions, ip)
+		}
+	}
+	for number, ch := range a.channels {
+		if ch.expires.Before(now) {
+			delete(a.channels, number)
+			delete(a.peers, ch.peer.String())
+		}
+	}
+	a.mux.Unlock()
+}
+
+// turnServer is TURN server that shares UDP sockets with STUN server,
+// implementing RFC 5766 with long-term credential mechanism.
+type turnServer struct {
+	realm     string
+	relayIP   net.IP
+	minPort   int
+	maxPort   int
+	passwords map[string]string
+	nonceKey  []byte
+	// secret is shared secret for TURN REST API ephemeral credentials,
+	// nil if disabled.
+	secret []byte
+	// allowedPeers are exceptions from turnDeniedPeers.
+	allowedPeers []*net.IPNet
+
+	mux         sync.RWMutex
+	allocations map[string]*allocation
+}
+
+func newTURNServer(realm string, relayIP net.IP, minPort, maxPort int, passwords map[string]string) (*turnServer, error) {
+	if minPort <= 0 || maxPort < minPort || maxPort > 0xFFFF {
+		return nil, fmt.Errorf("bad relay port range %d-%d", minPort, maxPort)
+	}
+	s := &turnServer{
+		realm:       realm,
+		relayIP:     relayIP,
+		minPort:     minPort,
+		maxPort:     maxPort,
+		passwords:   passwords,
+		nonceKey:    make([]byte, 16),
+		allocations: make(map[string]*allocation),
+	}
+	if _, err := rand.Read(s.nonceKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// peerAllowed reports whether relay can send data to peer with ip.
+func (s *turnServer) peerAllowed(ip net.IP) bool {
+	return !containsIP(turnDeniedPeers, ip) || containsIP(s.allowedPeers, ip)
+}
+
+// checkPeers returns 403 Forbidden if any of peers is not allowed,
+// RFC 5766 Section 9.
+func (s *turnServer) checkPeers(peers []*net.UDPAddr) stun.ErrorCode {
+	for _, peer := range peers {
+		if !s.peerAllowed(peer.IP) {
+			turnStats.Add("denied_peers", 1)
+			log.Println("turn: denied peer", peer)
+			return stun.CodeForbidden
+		}
+	}
+	return 0
+}
+
+// fiveTuple returns allocation key for client and server addresses.
+func fiveTuple(client, server net.Addr) string {
+	return client.String() + "/" + server.String()
+}
+
+func (s *turnServer) get(key string) *allocation {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.allocations[key]
+}
+
+// allocated reports whether client has allocation on server socket.
+func (s *turnServer) allocated(client, server net.Addr) bool {
+	return s.get(fiveTuple(client, server)) != nil
+}
+
+func (s *turnServer) remove(a *allocation) {
+	s.mux.Lock()
+	if s.allocations[a.key] == a {
+		delete(s.allocations, a.key)
+		turnStats.Add("allocations", -1)
+	}
+	s.mux.Unlock()
+	a.relay.Close()
+	log.Println("turn: removed allocation for", a.client)
+}
+
+func (s *turnServer) newNonce() stun.Nonce {
+	ts := strconv.FormatInt(time.Now().Unix(), 16)
+	return stun.NewNonce(ts + "-" + s.nonceMAC(ts))
+}
+
+func (s *turnServer) nonceMAC(ts string) string {
+	mac := hmac.New(sha256.New, s.nonceKey)
+	fmt.Fprint(mac, ts)
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// validNonce reports whether nonce was issued by server and not expired.
+func (s *turnServer) validNonce(nonce string) bool {
+	var ts, mac string
+	for i := range nonce {
+		if nonce[i] == '-' {
+			ts, mac = nonce[:i], nonce[i+1:]
+			break
+		}
+	}
+	if !hmac.Equal([]byte(mac), []byte(s.nonceMAC(ts))) {
+		return false
+	}
+	issued, err := strconv.ParseInt(ts, 16, 64)
+	if err != nil {
+		return false
+	}
+	return time.Since(time.Unix(issued, 0)) < turnNonceLifetime
+}
+
+func (s *turnServer) password(username string) (string, bool) {
+	if p, ok := s.passwords[username]; ok {
+		return p, true
+	}
+	if s.secret == nil {
+		return "", false
+	}
+	// Ephemeral username is "expiry:userid", where expiry is unix
+	// timestamp of credentials expiration.
+	idx := strings.Index(username, ":")
+	if idx <= 0 {
+		return "", false
+	}
+	expiry, err := strconv.ParseInt(username[:idx], 10, 64)
+	if err != nil || time.Now().After(time.Unix(expiry, 0)) {
+		return "", false
+	}
+	return s.ephemeralPassword(username), true
+}
+
+// ephemeralPassword returns password for ephemeral username.
+func (s *turnServer) ephemeralPassword(username string) string {
+	mac := hmac.New(sha1.New, s.secret)
+	fmt.Fprint(mac, username)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newUserID returns random user id for ephemeral credentials.
+func newUserID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ephemeralCredentials returns time-limited username and password for
+// user, as described in "A REST API For Access To TURN Services".
+func (s *turnServer) ephemeralCredentials(userID string, ttl time.Duration) (username, password string) {
+	expiry := time.Now().Add(ttl).Unix()
+	username = strconv.FormatInt(expiry, 10) + ":" + userID
+	return username, s.ephemeralPassword(username)
+}
+
+// authenticate checks long-term credentials of request, setting
+// ctx.integrity on success. Otherwise returns error code.
+//
+// RFC 5389 Section 10.2
+func (s *turnServer) authenticate(ctx *stunContext) stun.ErrorCode {
+	req := ctx.req
+	if !req.Contains(stun.AttrMessageIntegrity) {
+		return stun.CodeUnauthorised
+	}
+	var (
+		username stun.Username
+		realm    stun.Realm
+		nonce    stun.Nonce
+	)
+	if err := req.Parse(&username, &realm, &nonce); err != nil {
+		return stun.CodeBadRequest
+	}
+	if !s.validNonce(nonce.String()) {
+		return stun.CodeStaleNonce
+	}
+	password, ok := s.password(username.String())
+	if !ok {
+		return stun.CodeUnauthorised
+	}
+	integrity := stun.NewLongTermIntegrity(username.String(), s.realm, password)
+	if err := integrity.Check(req); err != nil {
+		log.Println("turn: failed to check integrity:", err)
+		return stun.CodeUnauthorised
+	}
+	ctx.integrity = integrity
+	ctx.username = username.String()
+	return 0
+}
+
+// process processes TURN request, building response in ctx.res.
+func (s *turnServer) process(ctx *stunContext) error {
+	req := ctx.req
+	switch code := s.authenticate(ctx); code {
+	case 0:
+	case stun.CodeUnauthorised, stun.CodeStaleNonce:
+		return ctx.buildError(code, stun.NewRealm(s.realm), s.newNonce())
+	default:
+		return ctx.buildError(code)
+	}
+	if unknown := ctx.unknownAttributes(); len(unknown) > 0 {
+		return ctx.buildError(stun.CodeUnknownAttribute, unknown)
+	}
+	res := ctx.res
+	res.Type = stun.NewType(req.Type.Method, stun.ClassSuccessResponse)
+	res.TransactionID = req.TransactionID
+	res.WriteHeader()
+	var code stun.ErrorCode
+	switch req.Type.Method {
+	case stun.MethodAllocate:
+		code = s.allocate(ctx)
+	case stun.MethodRefresh:
+		code = s.refresh(ctx)
+	case stun.MethodCreatePermission:
+		code = s.createPermission(ctx)
+	case stun.MethodChannelBind:
+		code = s.channelBind(ctx)
+	default:
+		code = stun.CodeBadRequest
+	}
+	if code != 0 {
+		return ctx.buildError(code)
+	}
+	if err := software.AddTo(res); err != nil {
+		return err
+	}
+	return ctx.sign()
+}
+
+// lifetime returns allocation lifetime requested by client.
+func (s *turnServer) lifetime(req *stun.Message) (time.Duration, error) {
+	var l lifetime
+	switch err := l.GetFrom(req); err {
+	case nil:
+	case stun.ErrAttributeNotFound:
+		return turnDefaultLifetime, nil
+	default:
+		return 0, err
+	}
+	d := time.Duration(l)
+	if d == 0 {
+		return 0, nil
+	}
+	if d < turnDefaultLifetime {
+		d = turnDefaultLifetime
+	}
+	if d > turnMaxLifetime {
+		d = turnMaxLifetime
+	}
+	return d, nil
+}
+
+// listenRelay binds relay socket on random port from range.
+func (s *turnServer) listenRelay() (*net.UDPConn, error) {
+	var (
+		n     = s.maxPort - s.minPort + 1
+		start = 0
+	)
+	if r, err := rand.Int(rand.Reader, big.NewInt(int64(n))); err == nil {
+		start = int(r.Int64())
+	}
+	var lastErr error
+	for i := 0; i < n; i++ {
+		port := s.minPort + (start+i)%n
+		c, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err == nil {
+			return c, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (s *turnServer) allocate(ctx *stunContext) stun.ErrorCode {
+	var (
+		req    = ctx.req
+		client = ctx.remote.(*net.UDPAddr)
+		key    = fiveTuple(ctx.remote, ctx.local)
+	)
+	if s.get(key) != nil {
+		return stun.CodeAllocMismatch
+	}
+	var transport requestedTransport
+	if err := transport.GetFrom(req); err != nil {
+		return stun.CodeBadRequest
+	}
+	if transport != protoUDP {
+		return stun.CodeUnsupportedTransProto
+	}
+	d, err := s.lifetime(req)
+	if err != nil {
+		return stun.CodeBadRequest
+	}
+	if d == 0 {
+		d = turnDefaultLifetime
+	}
+	relay, err := s.listenRelay()
+	if err != nil {
+		log.Println("turn: failed to bind relay:", err)
+		return stun.CodeInsufficientCapacity
+	}
+	a := &allocation{
+		key:         key,
+		client:      client,
+		conn:        ctx.udp.conns[ctx.ip][ctx.port],
+		relay:       relay,
+		username:    ctx.username,
+		expires:     time.Now().Add(d),
+		permissions: make(map[string]time.Time),
+		channels:    make(map[uint16]*turnChannel),
+		peers:       make(map[string]*turnChannel),
+	}
+	s.mux.Lock()
+	// Checking again, because retransmitted Allocate requests can be
+	// processed by different workers concurrently.
+	if s.allocations[key] != nil {
+		s.mux.Unlock()
+		relay.Close()
+		return stun.CodeAllocMismatch
+	}
+	if len(s.allocations) >= turnMaxAllocations {
+		s.mux.Unlock()
+		relay.Close()
+		return stun.CodeAllocQuotaReached
+	}
+	s.allocations[key] = a
+	s.mux.Unlock()
+	turnStats.Add("allocations", 1)
+	go a.serveRelay()
+	log.Println("turn: allocated", relay.LocalAddr(), "for", client)
+
+	res := ctx.res
+	relayed := xorAddr{
+		Type: stun.AttrXORRelayedAddress,
+		IP:   s.relayIP,
+		Port: relay.LocalAddr().(*net.UDPAddr).Port,
+	}
+	if err := relayed.AddTo(res); err != nil {
+		return stun.CodeServerError
+	}
+	if err := lifetime(d).AddTo(res); err != nil {
+		return stun.CodeServerError
+	}
+	if err := (stun.XORMappedAddress{IP: client.IP, Port: client.Port}).AddTo(res); err != nil {
+		return stun.CodeServerError
+	}
+	return 0
+}
+
+// allocationFor returns allocation of request or error code.
+func (s *turnServer) allocationFor(ctx *stunContext) (*allocation, stun.ErrorCode) {
+	a := s.get(fiveTuple(ctx.remote, ctx.local))
+	if a == nil {
+		return nil, stun.CodeAllocMismatch
+	}
+	if a.username != ctx.username {
+		return nil, stun.CodeWrongCredentials
+	}
+	return a, 0
+}
+
+func (s *turnServer) refresh(ctx *stunContext) stun.ErrorCode {
+	a, code := s.allocationFor(ctx)
+	if code != 0 {
+		return code
+	}
+	d, err := s.lifetime(ctx.req)
+	if err != nil {
+		return stun.CodeBadRequest
+	}
+	if d == 0 {
+		s.remove(a)
+	} else {
+		a.mux.Lock()
+		a.expires = time.Now().Add(d)
+		a.mux.Unlock()
+	}
+	if err := lifetime(d).AddTo(ctx.res); err != nil {
+		return stun.CodeServerError
+	}
+	return 0
+}
+
+func (s *turnServer) createPermission(ctx *stunContext) stun.ErrorCode {
+	a, code := s.allocationFor(ctx)
+	if code != 0 {
+		return code
+	}
+	peers, err := xorAddresses(ctx.req, stun.AttrXORPeerAddress)
+	if err != nil || len(peers) == 0 {
+		return stun.CodeBadRequest
+	}
+	if code = s.checkPeers(peers); code != 0 {
+		return code
+	}
+	expires := time.Now().Add(turnPermissionLifetime)
+	a.mux.Lock()
+	for _, peer := range peers {
+		a.permissions[peer.IP.String()] = expires
+	}
+	a.mux.Unlock()
+	return 0
+}
+
+func (s *turnServer) channelBind(ctx *stunContext) stun.ErrorCode {
+	a, code := s.allocationFor(ctx)
+	if code != 0 {
+		return code
+	}
+	var number channelNumber
+	if err := number.GetFrom(ctx.req); err != nil {
+		return stun.CodeBadRequest
+	}
+	if number < turnMinChannel || number > turnMaxChannel {
+		return stun.CodeBadRequest
+	}
+	peers, err := xorAddresses(ctx.req, stun.AttrXORPeerAddress)
+	if err != nil || len(peers) != 1 {
+		return stun.CodeBadRequest
+	}
+	if code = s.checkPeers(peers); code != 0 {
+		return code
+	}
+	var (
+		peer = peers[0]
+		now  = time.Now()
+	)
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	ch := a.channels[uint16(number)]
+	if bound := a.peers[peer.String()]; bound != ch {
+		// Peer is already bound to another channel.
+		return stun.CodeBadRequest
+	}
+	if ch != nil && ch.peer.String() != peer.String() {
+		// Channel is already bound to another peer.
+		return stun.CodeBadRequest
+	}
+	if ch == nil {
+		ch = &turnChannel{
+			number: uint16(number),
+			peer:   peer,
+		}
+		a.channels[ch.number] = ch
+		a.peers[peer.String()] = ch
+	}
+	ch.expires = now.Add(turnChannelLifetime)
+	a.permissions[peer.IP.String()] = now.Add(turnPermissionLifetime)
+	return 0
+}
+
+// isChannelData reports whether b looks like ChannelData message.
+//
+// RFC 5766 Section 11.4
+func isChannelData(b []byte) bool {
+	return len(b) >= channelDataHeaderSize && b[0]&0xC0 == 0x40
+}
+
+// handleData relays ChannelData messages and Send indications from
+// client to peers, returning false if b is not one of them.
+func (s *turnServer) handleData(client, server net.Addr, b []byte) bool {
+	if isChannelData(b) {
+		a := s.get(fiveTuple(client, server))
+		if a == nil {
+			return true
+		}
+		var (
+			number = binary.BigEndian.Uint16(b[0:2])
+			length = int(binary.BigEndian.Uint16(b[2:4]))
+		)
+		if channelDataHeaderSize+length > len(b) {
+			return true
+		}
+		a.sendToChannel(number, b[channelDataHeaderSize:channelDataHeaderSize+length])
+		return true
+	}
+	if !stun.IsMessage(b) {
+		return false
+	}
+	var t stun.MessageType
+	t.ReadValue(binary.BigEndian.Uint16(b[0:2]))
+	if t != sendIndication {
+		return false
+	}
+	a := s.get(fiveTuple(client, server))
+	if a == nil {
+		return true
+	}
+	m := &stun.Message{Raw: b}
+	if err := m.Decode(); err != nil {
+		return true
+	}
+	peers, err := xorAddresses(m, stun.AttrXORPeerAddress)
+	if err != nil || len(peers) != 1 {
+		return true
+	}
+	data, err := m.Get(stun.AttrData)
+	if err != nil {
+		return true
+	}
+	a.sendTo(peers[0], data)
+	return true
+}
+
+func (s *turnServer) collect() {
+	now := time.Now()
+	var expired []*allocation
+	s.mux.RLock()
+	for _, a := range s.allocations {
+		a.mux.Lock()
+		if a.expires.Before(now) {
+			expired = append(expired, a)
+		}
+		a.mux.Unlock()
+		a.collect(now)
+	}
+	s.mux.RUnlock()
+	for _, a := range expired {
+		s.remove(a)
+	}
+}
+
+func (s *turnServer) gc() {
+	ticker := time.NewTicker(time.Second * 10)
+	for range ticker.C {
+		s.collect()
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestTURNServerPeerAllowed(t *testing.T) {
+	s := &turnServer{allowedPeers: mustParseCIDRs("10.1.0.0/16")}
+	for _, tc := range []struct {
+		ip      string
+		allowed bool
+	}{
+		{"203.0.113.1", true},
+		{"2001:db8::1", true},
+		{"127.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"0.0.0.0", false},
+		{"10.0.0.1", false},
+		{"10.1.2.3", true},
+		{"172.16.0.1", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+	} {
+		if got := s.peerAllowed(net.ParseIP(tc.ip)); got != tc.allowed {
+			t.Errorf("peerAllowed(%s) = %v, want %v", tc.ip, got, tc.allowed)
+		}
+	}
+}
+
+// newTestTURN returns TURN server on loopback UDP socket with user
+// "user" and password "pass".
+func newTestTURN(t *testing.T) (*turnServer, *udpServer) {
+	t.Helper()
+	u, err := listenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { u.Close() })
+	s, err := newTURNServer("gortc.io", net.IPv4(127, 0, 0, 1), 40000, 49999, map[string]string{
+		"user": "pass",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.mux.RLock()
+		var allocations []*allocation
+		for _, a := range s.allocations {
+			allocations = append(allocations, a)
+		}
+		s.mux.RUnlock()
+		for _, a := range allocations {
+			s.remove(a)
+		}
+	})
+	u.turn = s
+	return s, u
+}
+
+// allocateRequest returns Allocate request signed with long-term
+// credentials.
+func allocateRequest(t *testing.T, s *turnServer, username, password string) *stun.Message {
+	t.Helper()
+	return stun.MustBuild(stun.TransactionID,
+		stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		requestedTransport(protoUDP),
+		stun.NewUsername(username),
+		stun.NewRealm(s.realm),
+		s.newNonce(),
+		stun.NewLongTermIntegrity(username, s.realm, password),
+	)
+}
+
+// processTURN processes request from client and returns error code of
+// response, zero if request succeeded.
+func processTURN(t *testing.T, u *udpServer, client net.Addr, req *stun.Message) stun.ErrorCode {
+	t.Helper()
+	ctx := &stunContext{
+		req:    new(stun.Message),
+		res:    new(stun.Message),
+		local:  u.addrs[0][0],
+		remote: client,
+		udp:    u,
+	}
+	raw := append([]byte(nil), req.Raw...)
+	if err := processUDPPacket(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.res.Type.Class == stun.ClassSuccessResponse {
+		return 0
+	}
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(ctx.res); err != nil {
+		t.Fatal(err)
+	}
+	return code.Code
+}
+
+func TestTURNServerAllocateConcurrent(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	var (
+		s, u   = newTestTURN(t)
+		client = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+		req    = allocateRequest(t, s, "user", "pass")
+		codes  = make(chan stun.ErrorCode, 32)
+		start  = make(chan struct{})
+		wg     sync.WaitGroup
+	)
+	// Retransmissions of same Allocate request.
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			codes <- processTURN(t, u, client, req)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(codes)
+	allocated := 0
+	for code := range codes {
+		switch code {
+		case 0:
+			allocated++
+		case stun.CodeAllocMismatch:
+		default:
+			t.Errorf("unexpected code %d", code)
+		}
+	}
+	if allocated != 1 {
+		t.Errorf("allocated %d times", allocated)
+	}
+	s.mux.RLock()
+	n := len(s.allocations)
+	s.mux.RUnlock()
+	if n != 1 {
+		t.Errorf("%d allocations", n)
+	}
+}
+
+func TestTURNServerEphemeralCredentials(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, u := newTestTURN(t)
+	s.secret = []byte("secret")
+	config, ok := turnICEServer(s, []string{"127.0.0.1"})
+	if !ok {
+		t.Fatal("no credentials in configuration")
+	}
+	if want := "turn:127.0.0.1:" + strconv.Itoa(*portSTUN) + "?transport=udp"; len(config.URLs) != 1 || config.URLs[0] != want {
+		t.Errorf("unexpected urls %q", config.URLs)
+	}
+	if time.Duration(config.TTL)*time.Second != *turnTTL {
+		t.Errorf("unexpected ttl %d", config.TTL)
+	}
+	var (
+		expired, expiredPassword = s.ephemeralCredentials(newUserID(), -time.Minute)
+		other                    = &turnServer{secret: []byte("other")}
+		otherUsername, otherPass = other.ephemeralCredentials(newUserID(), time.Hour)
+		idx                      = strings.Index(config.Username, ":")
+		expiry, _                = strconv.ParseInt(config.Username[:idx], 10, 64)
+		// Expiration is extended, keeping credential.
+		extended = strconv.FormatInt(expiry+3600, 10) + config.Username[idx:]
+	)
+	for i, tc := range []struct {
+		name               string
+		username, password string
+		code               stun.ErrorCode
+	}{
+		{"Issued", config.Username, config.Credential, 0},
+		{"Static", "user", "pass", 0},
+		{"Expired", expired, expiredPassword, stun.CodeUnauthorised},
+		{"BadCredential", config.Username, config.Credential[1:], stun.CodeUnauthorised},
+		{"ExtendedExpiry", extended, config.Credential, stun.CodeUnauthorised},
+		{"OtherSecret", otherUsername, otherPass, stun.CodeUnauthorised},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Every request is from other client to get new allocation.
+			client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000 + i}
+			req := allocateRequest(t, s, tc.username, tc.password)
+			if code := processTURN(t, u, client, req); code != tc.code {
+				t.Errorf("got code %d, want %d", code, tc.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gortc/stun"
+)
+
+// udpServer serves STUN over UDP.
+//
+// Packets are read from every socket by dedicated goroutine and then
+// dispatched to pool of workers, so requests are processed
+// concurrently with pooled buffers and messages.
+//
+// If NAT behavior discovery (RFC 5780) is enabled, server holds socket
+// for every combination of primary and alternate IP and port, indexed
+// as [ip][port], where 0 is primary and 1 is alternate value.
+// Otherwise only [0][0] socket is used.
+type udpServer struct {
+	conns    [2][2]net.PacketConn
+	addrs    [2][2]*net.UDPAddr
+	behavior bool
+
+	// packets are processed concurrently by workers.
+	packets chan *udpPacket
+	// turn is embedded TURN server, nil if disabled.
+	turn *turnServer
+	// closed is set to 1 by Close, so readers stop on socket errors.
+	closed int32
+}
+
+// listenUDP binds udp server to primary address on network ("udp4" or
+// "udp6"). If alternate address is not nil, NAT behavior discovery is
+// enabled and sockets are bound on every combination of primary and
+// alternate IP and port.
+func listenUDP(network string, primary, alternate *net.UDPAddr) (*udpServer, error) {
+	s := &udpServer{
+		behavior: alternate != nil,
+	}
+	var (
+		ips   = []net.IP{primary.IP}
+		ports = []int{primary.Port}
+	)
+	if s.behavior {
+		ips = append(ips, alternate.IP)
+		ports = append(ports, alternate.Port)
+	}
+	for i, ip := range ips {
+		for j, port := range ports {
+			addr := &net.UDPAddr{IP: ip, Port: port}
+			log.Println("Listening", network, addr)
+			c, err := net.ListenUDP(network, addr)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			s.conns[i][j] = c
+			s.addrs[i][j] = c.LocalAddr().(*net.UDPAddr)
+		}
+	}
+	return s, nil
+}
+
+// Close closes all sockets, stopping readers and workers.
+func (s *udpServer) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	var err error
+	for i := range s.conns {
+		for _, c := range s.conns[i] {
+			if c == nil {
+				continue
+			}
+			if closeErr := c.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// processBehavior handles RFC 5780 attributes of request.
+func (s *udpServer) processBehavior(ctx *stunContext) error {
+	if !s.behavior {
+		return nil
+	}
+	var p responsePort
+	switch err := p.GetFrom(ctx.req); err {
+	case nil:
+		ctx.responsePort = int(p)
+	case stun.ErrAttributeNotFound:
+	default:
+		return err
+	}
+	switch err := ctx.change.GetFrom(ctx.req); err {
+	case nil, stun.ErrAttributeNotFound:
+	default:
+		return err
+	}
+	other := s.addrs[1-ctx.ip][1-ctx.port]
+	origin := s.origin(ctx)
+	if err := (addrAttr{
+		Type: attrOtherAddress,
+		IP:   other.IP,
+		Port: other.Port,
+	}).AddTo(ctx.res); err != nil {
+		return err
+	}
+	return addrAttr{
+		Type: attrResponseOrigin,
+		IP:   origin.IP,
+		Port: origin.Port,
+	}.AddTo(ctx.res)
+}
+
+// index returns index of socket that should send response.
+func (s *udpServer) index(ctx *stunContext) (ip, port int) {
+	ip, port = ctx.ip, ctx.port
+	if ctx.change.IP {
+		ip = 1 - ip
+	}
+	if ctx.change.Port {
+		port = 1 - port
+	}
+	return ip, port
+}
+
+func (s *udpServer) origin(ctx *stunContext) *net.UDPAddr {
+	ip, port := s.index(ctx)
+	return s.addrs[ip][port]
+}
+
+// send sends response to requested destination from requested socket.
+func (s *udpServer) send(ctx *stunContext) error {
+	ip, port := s.index(ctx)
+	to := ctx.remote
+	if ctx.responsePort != 0 {
+		to = &net.UDPAddr{
+			IP:   ctx.remote.(*net.UDPAddr).IP,
+			Port: ctx.responsePort,
+		}
+	}
+	_, err := s.conns[ip][port].WriteTo(ctx.res.Raw, to)
+	return err
+}
+
+// maxUDPPacketSize is size of packet buffers. Payload of UDP datagram
+// is at most 65507 bytes over IPv4 and 65527 bytes over IPv6 (without
+// jumbograms), so every datagram fits buffer and is never truncated.
+const maxUDPPacketSize = 65535
+
+// udpPacket is datagram received by one of server sockets.
+type udpPacket struct {
+	buf  []byte
+	n    int
+	addr net.Addr
+	// ip and port are indexes of receiving socket.
+	ip, port int
+}
+
+var (
+	udpStats = expvar.NewMap("stun_udp")
+
+	udpPacketPool = sync.Pool{
+		New: func() interface{} {
+			return &udpPacket{buf: make([]byte, maxUDPPacketSize)}
+		},
+	}
+	stunContextPool = sync.Pool{
+		New: func() interface{} {
+			return &stunContext{
+				req: new(stun.Message),
+				res: new(stun.Message),
+			}
+		},
+	}
+)
+
+// read reads packets from socket and passes them to workers.
+func (s *udpServer) read(ip, port int) {
+	conn := s.conns[ip][port]
+	log.Println("Started STUN server on", conn.LocalAddr())
+	for {
+		p := udpPacketPool.Get().(*udpPacket)
+		n, addr, err := conn.ReadFrom(p.buf)
+		if err != nil {
+			udpPacketPool.Put(p)
+			if atomic.LoadInt32(&s.closed) == 1 {
+				return
+			}
+			log.Fatalln("c.ReadFrom:", err)
+		}
+		// Relayed traffic of TURN clients is not rate limited.
+		relayed := s.turn != nil && s.turn.allocated(addr, s.addrs[ip][port])
+		if !relayed && !limiter.allow(addr.(*net.UDPAddr).IP) {
+			udpPacketPool.Put(p)
+			continue
+		}
+		p.n, p.addr, p.ip, p.port = n, addr, ip, port
+		s.packets <- p
+	}
+}
+
+func (s *udpServer) process(p *udpPacket) {
+	if s.turn != nil && s.turn.handleData(p.addr, s.addrs[p.ip][p.port], p.buf[:p.n]) {
+		return
+	}
+	log.Printf("udp: got packet len(%d) from %s", p.n, p.addr)
+	ctx := stunContextPool.Get().(*stunContext)
+	ctx.local = s.addrs[p.ip][p.port]
+	ctx.remote = p.addr
+	ctx.udp = s
+	ctx.ip, ctx.port = p.ip, p.port
+	// processing binding request
+	if err := processUDPPacket(ctx, p.buf[:p.n]); err != nil {
+		udpStats.Add("dropped", 1)
+		log.Println("failed to process UDP packet:", err, "from addr", p.addr)
+	} else {
+		udpStats.Add("processed", 1)
+		log.Printf("stun: parsed message %q from %s", ctx.req, p.addr)
+		if err = s.send(ctx); err != nil {
+			log.Println("failed to send packet:", err)
+		}
+	}
+	ctx.reset()
+	stunContextPool.Put(ctx)
+}
+
+func (s *udpServer) work() {
+	for p := range s.packets {
+		s.process(p)
+		udpPacketPool.Put(p)
+	}
+}
+
+// serve starts workers and reading from all sockets. Workers are
+// stopped when all readers are stopped by Close.
+func (s *udpServer) serve(workers int) {
+	s.packets = make(chan *udpPacket, workers)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	var readers sync.WaitGroup
+	for i := range s.conns {
+		for j, c := range s.conns[i] {
+			if c == nil {
+				continue
+			}
+			readers.Add(1)
+			go func(i, j int) {
+				defer readers.Done()
+				s.read(i, j)
+			}(i, j)
+		}
+	}
+	go func() {
+		readers.Wait()
+		close(s.packets)
+	}()
+}
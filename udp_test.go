@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func BenchmarkUDPServer(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("Workers%d", workers), func(b *testing.B) {
+			s, err := listenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			s.serve(workers)
+			server := s.addrs[0][0]
+			b.ReportAllocs()
+			b.SetBytes(int64(len(req.Raw)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				c, err := net.DialUDP("udp4", nil, server)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer c.Close()
+				buf := make([]byte, 1500)
+				for pb.Next() {
+					if _, err = c.Write(req.Raw); err != nil {
+						b.Error(err)
+						return
+					}
+					if err = c.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+						b.Error(err)
+						return
+					}
+					n, err := c.Read(buf)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if !stun.IsMessage(buf[:n]) {
+						b.Error("response is not STUN message")
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// getAddrAttr decodes address attribute of type t that is encoded like
+// MAPPED-ADDRESS.
+func getAddrAttr(t *testing.T, m *stun.Message, attr stun.AttrType) *net.UDPAddr {
+	t.Helper()
+	v, err := m.Get(attr)
+	if err != nil {
+		t.Fatalf("%s: %v", attr, err)
+	}
+	if len(v) < 4+net.IPv4len {
+		t.Fatalf("%s: bad length %d", attr, len(v))
+	}
+	return &net.UDPAddr{
+		IP:   net.IP(v[4:]),
+		Port: int(binary.BigEndian.Uint16(v[2:4])),
+	}
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+func TestUDPServerBehavior(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, err := listenUDP("udp4",
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.serve(2)
+	listen := func() *net.UDPConn {
+		c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	var (
+		client = listen()
+		other  = listen()
+		buf    = make([]byte, 1500)
+	)
+	for _, tc := range []struct {
+		name string
+		// to is index of socket that receives request.
+		to     [2]int
+		change changeRequest
+		// from is index of socket that should send response.
+		from [2]int
+		// responsePort is true if RESPONSE-PORT of other client
+		// socket is requested.
+		responsePort bool
+	}{
+		{name: "NoChange", from: [2]int{0, 0}},
+		{name: "ChangeIP", change: changeRequest{IP: true}, from: [2]int{1, 0}},
+		{name: "ChangePort", change: changeRequest{Port: true}, from: [2]int{0, 1}},
+		{name: "ChangeBoth", change: changeRequest{IP: true, Port: true}, from: [2]int{1, 1}},
+		{name: "Alternate", to: [2]int{1, 1}, from: [2]int{1, 1}},
+		{name: "AlternateChangeIP", to: [2]int{1, 1}, change: changeRequest{IP: true}, from: [2]int{0, 1}},
+		{name: "ResponsePort", from: [2]int{0, 0}, responsePort: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setters := []stun.Setter{stun.TransactionID, stun.BindingRequest, tc.change}
+			conn := client
+			if tc.responsePort {
+				conn = other
+				setters = append(setters, responsePort(other.LocalAddr().(*net.UDPAddr).Port))
+			}
+			req := stun.MustBuild(setters...)
+			if _, err := client.WriteTo(req.Raw, s.addrs[tc.to[0]][tc.to[1]]); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := &stun.Message{Raw: buf[:n]}
+			if err = res.Decode(); err != nil {
+				t.Fatal(err)
+			}
+			if res.Type != bindingSuccessResponse || res.TransactionID != req.TransactionID {
+				t.Fatalf("unexpected response %s", res)
+			}
+			want := s.addrs[tc.from[0]][tc.from[1]]
+			if !sameAddr(from, want) {
+				t.Errorf("response is sent from %s, want %s", from, want)
+			}
+			if origin := getAddrAttr(t, res, attrResponseOrigin); !sameAddr(origin, want) {
+				t.Errorf("RESPONSE-ORIGIN is %s, want %s", origin, want)
+			}
+			otherAddr := s.addrs[1-tc.to[0]][1-tc.to[1]]
+			if got := getAddrAttr(t, res, attrOtherAddress); !sameAddr(got, otherAddr) {
+				t.Errorf("OTHER-ADDRESS is %s, want %s", got, otherAddr)
+			}
+			var mapped stun.XORMappedAddress
+			if err = mapped.GetFrom(res); err != nil {
+				t.Fatal(err)
+			}
+			if mapped.Port != client.LocalAddr().(*net.UDPAddr).Port {
+				t.Errorf("XOR-MAPPED-ADDRESS is %s", mapped)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gortc/sdp"
+)
+
+// Content types of WHIP and WHEP, RFC 9725 Section 4.
+const (
+	contentTypeSDP         = "application/sdp"
+	contentTypeTrickleFrag = "application/trickle-ice-sdpfrag"
+)
+
+// whipMaxBody limits size of offers and SDP fragments.
+const whipMaxBody = 64 * 1024
+
+// whipEndpoint serves WHIP or WHEP endpoint at path and its resources
+// at path + "/" + ufrag, where ufrag is local ice-ufrag of ICE-lite
+// session. ICE is handled by ICE-lite agent on STUN sockets.
+//
+// Endpoint is for testing ICE connectivity of WHIP and WHEP clients:
+// DTLS is not terminated, so media never flows, and every answer has
+// Warning header about it.
+type whipEndpoint struct {
+	path string
+	// direction of accepted medias in answer, "recvonly" for WHIP
+	// and "sendonly" for WHEP.
+	direction string
+	// token is required bearer token if not empty.
+	token string
+}
+
+func hasContentType(r *http.Request, contentType string) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == contentType
+}
+
+func whipETag(ufrag string) string {
+	return `"` + ufrag + `"`
+}
+
+// readSDP reads and decodes body of r, writing error response on failure.
+func readSDP(w http.ResponseWriter, r *http.Request, contentType string) (sdp.Session, bool) {
+	if !hasContentType(r, contentType) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, whipMaxBody))
+	if err != nil {
+		log.Println("http: ReadAll body failed:", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	s, err := sdp.DecodeSession(data, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "failed to decode:", err)
+		return nil, false
+	}
+	return s, true
+}
+
+// authorized reports whether r has bearer token of endpoint.
+func (e whipEndpoint) authorized(r *http.Request) bool {
+	auth := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(auth, []byte("Bearer "+e.token)) == 1
+}
+
+func (e whipEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+	h.Set("Access-Control-Expose-Headers", "Location, ETag, Accept-Patch, Warning")
+	if r.Method == http.MethodOptions {
+		h.Set("Accept-Post", contentTypeSDP)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if len(e.token) > 0 && !e.authorized(r) {
+		h.Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	ufrag := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, e.path), "/")
+	switch {
+	case len(ufrag) == 0 && r.Method == http.MethodPost:
+		e.create(w, r)
+	case len(ufrag) == 0:
+		h.Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case r.Method == http.MethodPatch:
+		e.trickle(w, r, ufrag)
+	case r.Method == http.MethodDelete:
+		if !lite.remove(e.path, ufrag) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Println("http:", e.path, "resource", ufrag, "deleted by", r.RemoteAddr)
+		w.WriteHeader(http.StatusOK)
+	default:
+		h.Set("Allow", "PATCH, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// create answers offer, creating resource, RFC 9725 Section 4.2.
+func (e whipEndpoint) create(w http.ResponseWriter, r *http.Request) {
+	ips, err := candidateIPs()
+	if err != nil {
+		log.Println("http: failed to answer offer:", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	offer, ok := readSDP(w, r, contentTypeSDP)
+	if !ok {
+		return
+	}
+	session, answer, err := lite.answer(offer, ips, e.direction, e.path)
+	switch err {
+	case nil:
+	case errTooManySessions:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	default:
+		log.Println("http: failed to answer offer:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "failed to answer:", err)
+		return
+	}
+	log.Println("http:", e.path, "resource", session.LocalUfrag, "created by", r.RemoteAddr)
+	h := w.Header()
+	h.Set("Content-Type", contentTypeSDP)
+	h.Set("Location", e.path+"/"+session.LocalUfrag)
+	h.Set("ETag", whipETag(session.LocalUfrag))
+	h.Set("Accept-Patch", contentTypeTrickleFrag)
+	h.Set("Warning", iceLiteWarning)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(encodeSDP(answer))
+}
+
+// trickle adds remote candidates to resource, RFC 9725 Section 4.3.
+func (e whipEndpoint) trickle(w http.ResponseWriter, r *http.Request, ufrag string) {
+	if match := r.Header.Get("If-Match"); len(match) > 0 && match != "*" && match != whipETag(ufrag) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	frag, ok := readSDP(w, r, contentTypeTrickleFrag)
+	if !ok {
+		return
+	}
+	switch err := lite.trickle(e.path, ufrag, frag); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errNoSession:
+		w.WriteHeader(http.StatusNotFound)
+	case errICERestart:
+		// Trickle is supported, but restarts are not.
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "failed to trickle:", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// whipRequest serves request to endpoint e and returns recorded
+// response, headers are pairs of name and value.
+func whipRequest(e whipEndpoint, method, path, contentType, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	return w
+}
+
+func TestWHIPEndpoint(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(l *iceLite, ip string) { lite, *publicIPv4 = l, ip }(lite, *publicIPv4)
+	lite = newTestICELite(t)
+	*publicIPv4 = "192.0.2.1"
+	var (
+		whip  = whipEndpoint{path: "/whip", direction: "recvonly", token: "secret"}
+		whep  = whipEndpoint{path: "/whep", direction: "sendonly", token: "secret"}
+		auth  = []string{"Authorization", "Bearer secret"}
+		offer = strings.Join(testOffer, "\r\n") + "\r\n"
+	)
+	t.Run("Preflight", func(t *testing.T) {
+		w := whipRequest(whip, http.MethodOptions, "/whip", "", "")
+		if w.Code != http.StatusNoContent {
+			t.Errorf("code: %d", w.Code)
+		}
+		h := w.Header()
+		if h.Get("Access-Control-Allow-Origin") != "*" {
+			t.Error("no Access-Control-Allow-Origin")
+		}
+		for _, header := range []string{"Authorization", "If-Match"} {
+			if !strings.Contains(h.Get("Access-Control-Allow-Headers"), header) {
+				t.Errorf("%s is not allowed", header)
+			}
+		}
+		for _, header := range []string{"Location", "ETag", "Warning"} {
+			if !strings.Contains(h.Get("Access-Control-Expose-Headers"), header) {
+				t.Errorf("%s is not exposed", header)
+			}
+		}
+		if h.Get("Accept-Post") != contentTypeSDP {
+			t.Errorf("Accept-Post: %q", h.Get("Accept-Post"))
+		}
+	})
+	for _, tc := range []struct {
+		name    string
+		headers []string
+	}{
+		{name: "NoToken"},
+		{name: "BadToken", headers: []string{"Authorization", "Bearer other"}},
+		{name: "NotBearer", headers: []string{"Authorization", "secret"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := whipRequest(whip, http.MethodPost, "/whip", contentTypeSDP, offer, tc.headers...)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("code: %d", w.Code)
+			}
+			if w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Error("no WWW-Authenticate")
+			}
+		})
+	}
+	if w := whipRequest(whip, http.MethodPost, "/whip", "text/plain", offer, auth...); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("unexpected code %d for bad content type", w.Code)
+	}
+
+	w := whipRequest(whip, http.MethodPost, "/whip", contentTypeSDP, offer, auth...)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("code: %d, body: %s", w.Code, w.Body)
+	}
+	var (
+		h        = w.Header()
+		location = h.Get("Location")
+		ufrag    = strings.TrimPrefix(location, "/whip/")
+	)
+	if !strings.HasPrefix(location, "/whip/") || len(ufrag) != iceUfragLength {
+		t.Fatalf("bad Location %q", location)
+	}
+	if h.Get("ETag") != `"`+ufrag+`"` {
+		t.Errorf("ETag: %q", h.Get("ETag"))
+	}
+	if h.Get("Content-Type") != contentTypeSDP {
+		t.Errorf("Content-Type: %q", h.Get("Content-Type"))
+	}
+	if h.Get("Warning") != iceLiteWarning {
+		t.Errorf("Warning: %q", h.Get("Warning"))
+	}
+	if !strings.Contains(w.Body.String(), "a=ice-ufrag:"+ufrag) {
+		t.Errorf("no ufrag in answer:\n%s", w.Body)
+	}
+	if lite.snapshot("", ufrag) != nil {
+		t.Error("WHIP session is exposed without token")
+	}
+
+	frag := strings.Join([]string{
+		"a=ice-ufrag:remote",
+		"a=ice-pwd:" + strings.Repeat("p", 22),
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"a=mid:0",
+		"a=candidate:1 1 udp 2130706431 198.51.100.1 5000 typ host",
+		"a=end-of-candidates",
+		"",
+	}, "\r\n")
+	for _, tc := range []struct {
+		name string
+		e    whipEndpoint
+		path string
+		body string
+		etag string
+		code int
+	}{
+		{name: "UnknownResource", e: whip, path: "/whip/unknown", body: frag, code: http.StatusNotFound},
+		{name: "OtherEndpoint", e: whep, path: "/whep/" + ufrag, body: frag, code: http.StatusNotFound},
+		{name: "ETagMismatch", e: whip, path: location, body: frag, etag: `"other"`, code: http.StatusPreconditionFailed},
+		{name: "ICERestart", e: whip, path: location, body: strings.Replace(frag, "ice-ufrag:remote", "ice-ufrag:other", 1), code: http.StatusUnprocessableEntity},
+		{name: "Trickle", e: whip, path: location, body: frag, etag: h.Get("ETag"), code: http.StatusNoContent},
+		{name: "AnyETag", e: whip, path: location, body: frag, etag: "*", code: http.StatusNoContent},
+	} {
+		t.Run("Patch"+tc.name, func(t *testing.T) {
+			headers := auth
+			if tc.etag != "" {
+				headers = append([]string{"If-Match", tc.etag}, auth...)
+			}
+			w := whipRequest(tc.e, http.MethodPatch, tc.path, contentTypeTrickleFrag, tc.body, headers...)
+			if w.Code != tc.code {
+				t.Errorf("code: %d, expected %d", w.Code, tc.code)
+			}
+		})
+	}
+	s := lite.snapshot("/whip", ufrag)
+	if s == nil {
+		t.Fatal("no session")
+	}
+	if len(s.RemoteCandidates) != 2 || !s.EndOfCandidates {
+		t.Errorf("unexpected trickled candidates %v, ended: %v", s.RemoteCandidates, s.EndOfCandidates)
+	}
+
+	if w := whipRequest(whep, http.MethodDelete, "/whep/"+ufrag, "", "", auth...); w.Code != http.StatusNotFound {
+		t.Errorf("unexpected code %d for deleting by other endpoint", w.Code)
+	}
+	if w := whipRequest(whip, http.MethodDelete, location, "", "", auth...); w.Code != http.StatusOK {
+		t.Errorf("unexpected code %d for delete", w.Code)
+	}
+	if w := whipRequest(whip, http.MethodDelete, location, "", "", auth...); w.Code != http.StatusNotFound {
+		t.Errorf("unexpected code %d for deleted resource", w.Code)
+	}
+	if w := whipRequest(whip, http.MethodGet, location, "", "", auth...); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected code %d for GET", w.Code)
+	}
+}